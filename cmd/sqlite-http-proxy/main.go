@@ -1,17 +1,23 @@
 package main
 
 import (
+	"context"
 	"crypto/tls"
 	"crypto/x509"
 	"database/sql"
+	"errors"
+	"expvar"
 	"fmt"
 	"log"
 	"net"
 	"net/http"
 	"os"
+	"os/signal"
 	"path/filepath"
+	"regexp"
 	"strconv"
 	"strings"
+	"syscall"
 	"time"
 
 	"github.com/elazarl/goproxy"
@@ -23,6 +29,7 @@ import (
 	"github.com/litesql/httpcache/config"
 	"github.com/litesql/httpcache/db"
 	proxyhandler "github.com/walterwanderley/sqlite-http-cache/http/proxy"
+	"github.com/walterwanderley/sqlite-http-cache/storage"
 )
 
 func main() {
@@ -40,6 +47,36 @@ func main() {
 	readOnly := fs.BoolLong("ro", "Read Only mode. Do not store new HTTP responses")
 	rfc9111 := fs.BoolLong("rfc9111", "Use RFC9111 spec")
 	shared := fs.BoolLong("shared", "Enable shared cache mode for RFC9111")
+	staleIfError := fs.IntLong("stale-if-error", 0, "Serve stale responses up to N seconds when the origin fails (0 only honors the stale-if-error directive in RFC9111 mode)")
+	headUpdate := fs.BoolLong("head-update", "Update the freshness of stored responses when HEAD requests pass through to the origin")
+	cachePOST := fs.StringListLong("cache-post", "List of URL regular expressions to cache POST responses (keyed on the request body hash)")
+	cachePOSTHeaders := fs.StringListLong("cache-post-header", "List of request headers included in the POST cache key")
+	disableRefresh := fs.BoolLong("disable-client-refresh", "Ignore request no-cache, max-age=0 and Pragma: no-cache in TTL mode (clients cannot bypass stored responses)")
+	rewriteTTL := fs.BoolLong("rewrite-ttl", "Rewrite Cache-Control max-age and Expires of the responses to the remaining --ttl (TTL mode)")
+	normalizeURL := fs.BoolLong("normalize-url", "Normalize the cache key URL: sort query parameters, lowercase host and drop the default port")
+	stripParams := fs.StringListLong("strip-param", "List of query parameters removed from the cache key (a trailing * matches a prefix, e.g. utm_*)")
+	keyHeaders := fs.StringListLong("key-header", "List of request headers included in the cache key")
+	rulesFile := fs.StringLong("rules", "", "Path to the caching rules file (per host/path policies)")
+	compress := fs.StringLong("compress", "", "Store the response bodies compressed, only gzip is supported (zstd is not)")
+	compressMinSize := fs.IntLong("compress-min-size", 1024, "Minimum body size in bytes to be compressed")
+	dedup := fs.BoolLong("dedup", "Store identical response bodies once per database (content-addressed blob table)")
+	maxDBSize := fs.StringLong("max-db-size", "", "Maximum size of each database file (e.g. 512MB), responses are evicted in the background")
+	maxDBRows := fs.Int64Long("max-db-rows", 0, "Maximum number of responses of each database, responses are evicted in the background")
+	maxObjectSize := fs.StringLong("max-object-size", "", "Maximum body size of the stored responses (e.g. 10MB)")
+	evictionPolicy := fs.StringEnumLong("eviction-policy", "Eviction policy used by --max-db-size and --max-db-rows", "lru", "lfu", "oldest")
+	memoryCacheSize := fs.StringLong("memory-cache-size", "", "Size of the in-memory cache of the most recently used responses, in front of the databases (e.g. 64MB)")
+	evictionInterval := fs.DurationLong("eviction-interval", time.Minute, "Interval between the database size checks")
+	readStrategy := fs.StringEnumLong("read-strategy", "Lookup strategy with several databases: race (first response found), ordered (databases in order), newest (most recent response) or round-robin", "race", "ordered", "newest", "round-robin")
+	sharding := fs.BoolLong("shard", "Store each URL in a single database chosen by consistent hashing (database paths must not change)")
+	shardRebalance := fs.BoolLong("shard-rebalance", "Move the responses stored in another database than the one chosen by --shard, in background (after adding databases)")
+	replicas := fs.IntLong("replicas", 1, "Number of databases storing each response")
+	replicaRepairInterval := fs.DurationLong("replica-repair-interval", 0, "Interval of the background repair copying the responses stored in fewer databases than --replicas (0 disables)")
+	writeQueueDepth := fs.IntLong("write-queue-depth", 1000, "Maximum number of responses waiting to be stored")
+	writeWorkers := fs.IntLong("write-workers", 1, "Number of goroutines storing the responses")
+	writeBatchSize := fs.IntLong("write-batch-size", 100, "Maximum number of responses stored in a transaction")
+	writeQueueBlock := fs.BoolLong("write-queue-block", "Wait for room in the write queue when it is full instead of dropping the response")
+	metrics := fs.BoolLong("metrics", "Serve the metrics at /debug/vars (requests to the proxy address)")
+	cacheStatus := fs.BoolLong("cache-status", "Add the Cache-Status header (RFC 9211) to the responses")
 	authUser := fs.StringLong("auth-user", "", "Username for proxy basic authentication")
 	authPass := fs.StringLong("auth-pass", "", "Password for proxy basic authentication")
 	_ = fs.String('c', "config", "", "config file (optional)")
@@ -57,6 +94,9 @@ func main() {
 	if len(fs.GetArgs()) == 0 {
 		log.Fatalf("Usage: %s <FLAGS> [DatabasePath1] [DatabasePathN\n\nExample:\n\t%s example.db example2.db example3.db\n", os.Args[0], os.Args[0])
 	}
+	if *shardRebalance && !*sharding {
+		log.Fatal("--shard-rebalance requires --shard")
+	}
 
 	if *verbose {
 		fmt.Printf("Using options: port=%d db-params=%s, h2=%v, ttl=%d, response-tables=%v, ca-cert=%s, ca-cert-key=%s, read-only=%v, rfc9111=%v shared-cache=%v\n",
@@ -65,9 +105,9 @@ func main() {
 
 	dbs := make([]*sql.DB, 0)
 	var (
-		repository db.Repository
-		tableList  []string
-		err        error
+		names     []string // identify the databases on the --shard ring
+		tableList []string
+		err       error
 	)
 
 	dsnList := make([]string, 0)
@@ -75,6 +115,7 @@ func main() {
 		if pattern == ":memory:" {
 			dsn := pattern + "?cache=shared"
 			dsnList = append(dsnList, dsn)
+			names = append(names, pattern)
 			continue
 		}
 		matches, err := filepath.Glob(pattern)
@@ -85,10 +126,12 @@ func main() {
 		for _, file := range matches {
 			dsn := fmt.Sprintf("file:%s?%s", file, *dbParams)
 			dsnList = append(dsnList, dsn)
+			names = append(names, file)
 		}
 		if len(matches) == 0 && !strings.Contains(pattern, "*") {
 			dsn := fmt.Sprintf("file:%s?%s", pattern, *dbParams)
 			dsnList = append(dsnList, dsn)
+			names = append(names, pattern)
 		}
 
 	}
@@ -124,18 +167,108 @@ func main() {
 
 		}
 	}
-	if len(dbs) == 1 {
-		repository, err = db.NewRepository(dbs[0], time.Duration(*ttl)*time.Second, *dbCleanupInterval, tableList...)
+	var (
+		querier         proxyhandler.RequestQuerier
+		dedupRepository *storage.DedupRepository
+		ring            *storage.Ring
+		dbQueriers      []storage.ResponseQuerier // queriers of each database
+	)
+	if *dedup {
+		dedupRepository, err = storage.NewDedupRepository(dbs, time.Duration(*ttl)*time.Second, *dbCleanupInterval)
 		if err != nil {
-			log.Fatalf("new repository: %v", err)
+			log.Fatalf("new dedup repository: %v", err)
 		}
-	} else {
-		repository, err = db.NewMultiDatabaseRepositoryWithTTL(time.Duration(*ttl)*time.Second, *dbCleanupInterval, dbs)
+		defer dedupRepository.Close()
+		querier = dedupRepository
+	}
+	if *sharding || *replicas > 1 || (len(dbs) > 1 && (*readStrategy != string(storage.Race) || dedupRepository != nil)) {
+		dbQueriers = make([]storage.ResponseQuerier, len(dbs))
+		for i, sqlDB := range dbs {
+			if dedupRepository != nil {
+				dbQueriers[i] = dedupRepository.Database(i)
+				continue
+			}
+			tables, err := db.ResponseTables(sqlDB)
+			if err != nil {
+				log.Fatalf("discovery response tables: %v", err)
+			}
+			dbRepository, err := db.NewRepository(sqlDB, time.Duration(*ttl)*time.Second, *dbCleanupInterval, tables...)
+			if err != nil {
+				log.Fatalf("new repository: %v", err)
+			}
+			defer dbRepository.Close()
+			dbQueriers[i] = dbRepository
+		}
+	}
+	if *sharding {
+		ring = storage.NewRing(names)
+		querier = storage.NewShardedRepository(ring, dbQueriers, *replicas)
+	} else if dbQueriers != nil {
+		querier, err = storage.NewMultiQuerier(storage.ReadStrategy(*readStrategy), dbQueriers)
 		if err != nil {
-			log.Fatalf("new multi database repository: %v", err)
+			log.Fatalf("invalid read-strategy: %v", err)
+		}
+	} else if dedupRepository == nil {
+		var repository db.Repository
+		if len(dbs) == 1 {
+			repository, err = db.NewRepository(dbs[0], time.Duration(*ttl)*time.Second, *dbCleanupInterval, tableList...)
+			if err != nil {
+				log.Fatalf("new repository: %v", err)
+			}
+		} else {
+			repository, err = db.NewMultiDatabaseRepositoryWithTTL(time.Duration(*ttl)*time.Second, *dbCleanupInterval, dbs)
+			if err != nil {
+				log.Fatalf("new multi database repository: %v", err)
+			}
+		}
+		defer repository.Close()
+		querier = repository
+	}
+
+	var memoryCache *storage.MemoryCache
+	if *memoryCacheSize != "" {
+		size, err := storage.ParseSize(*memoryCacheSize)
+		if err != nil {
+			log.Fatalf("invalid memory-cache-size: %v", err)
+		}
+		memoryCache, err = storage.NewMemoryCache(size)
+		if err != nil {
+			log.Fatalf("new memory cache: %v", err)
+		}
+		// the hits served from memory are recorded by the evictor
+		querier = memoryCache.Querier(querier)
+	}
+	if *maxDBSize != "" || *maxDBRows > 0 {
+		var maxBytes int64
+		if *maxDBSize != "" {
+			maxBytes, err = storage.ParseSize(*maxDBSize)
+			if err != nil {
+				log.Fatalf("invalid max-db-size: %v", err)
+			}
+		}
+		evictionConfig := storage.EvictionConfig{
+			MaxBytes: maxBytes,
+			MaxRows:  *maxDBRows,
+			Policy:   storage.EvictionPolicy(*evictionPolicy),
+			Interval: *evictionInterval,
+		}
+		if memoryCache != nil {
+			evictionConfig.Invalidator = memoryCache
+		}
+		evictor, err := storage.NewEvictor(dbs, evictionConfig)
+		if err != nil {
+			log.Fatalf("new evictor: %v", err)
+		}
+		defer evictor.Close()
+		querier = evictor.Querier(querier)
+	}
+	var maxObjectBytes int64
+	if *maxObjectSize != "" {
+		maxObjectBytes, err = storage.ParseSize(*maxObjectSize)
+		if err != nil {
+			log.Fatalf("invalid max-object-size: %v", err)
 		}
 	}
-	defer repository.Close()
 
 	proxy := goproxy.NewProxyHttpServer()
 	proxy.Verbose = *verbose
@@ -176,37 +309,209 @@ func main() {
 		cacheableStatus = config.DefaultStatusCodes()
 	}
 
+	cachePOSTPatterns := make([]*regexp.Regexp, 0)
+	for _, pattern := range *cachePOST {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			log.Fatalf("Invalid cache-post %q: %v", pattern, err)
+		}
+		cachePOSTPatterns = append(cachePOSTPatterns, re)
+	}
+
+	keyFunc := proxyhandler.URLKey
+	if *normalizeURL || len(*stripParams) > 0 || len(*keyHeaders) > 0 {
+		keyFunc = proxyhandler.NewKeyFunc(proxyhandler.KeyConfig{
+			SortQuery:       *normalizeURL,
+			StripParams:     *stripParams,
+			LowercaseHost:   *normalizeURL,
+			DropDefaultPort: *normalizeURL,
+			Headers:         *keyHeaders,
+		})
+	}
+
+	var (
+		rules  []*proxyhandler.Rule
+		tables interface{ HasTable(string) bool }
+		writer proxyhandler.ResponseWriter
+	)
+	if dedupRepository != nil {
+		// the dedup repository writes into the table of the response
+		writer, tables = dedupRepository, dedupRepository
+	} else {
+		tableWriter, err := storage.NewTableWriter(dbs, nil)
+		if err != nil {
+			log.Fatalf("new table writer: %v", err)
+		}
+		defer tableWriter.Close()
+		writer, tables = tableWriter, tableWriter
+	}
+	if memoryCache != nil {
+		// below the placement and the queue, to keep the database and table used
+		writer = memoryCache.Writer(writer)
+	}
+	if *rulesFile != "" {
+		rules, err = proxyhandler.LoadRules(*rulesFile)
+		if err != nil {
+			log.Fatalf("load rules %q: %v", *rulesFile, err)
+		}
+		for _, rule := range rules {
+			if rule.Table != "" && !tables.HasTable(rule.Table) {
+				log.Fatalf("rules: response table %q not found", rule.Table)
+			}
+		}
+	}
+	if *replicas > 1 {
+		replicatedWriter, err := storage.NewReplicatedWriter(writer, dbs, *replicas, ring)
+		if err != nil {
+			log.Fatalf("invalid replicas: %v", err)
+		}
+		if *replicaRepairInterval > 0 {
+			repairCtx, cancelRepair := context.WithCancel(context.Background())
+			defer cancelRepair()
+			go func() {
+				ticker := time.NewTicker(*replicaRepairInterval)
+				defer ticker.Stop()
+				for {
+					select {
+					case <-ticker.C:
+						copied, err := replicatedWriter.Repair(repairCtx, dbQueriers)
+						if err != nil {
+							proxy.Logger.Printf("ERROR: replica repair: %v", err)
+						}
+						if copied > 0 {
+							proxy.Logger.Printf("INFO: replica repair copied %d responses", copied)
+						}
+					case <-repairCtx.Done():
+						return
+					}
+				}
+			}()
+		}
+		writer = replicatedWriter
+	} else if ring != nil {
+		writer = storage.NewShardedWriter(ring, writer)
+	}
+	if ring != nil && *shardRebalance {
+		placement := writer
+		go func() {
+			moved, err := storage.Rebalance(context.Background(), ring, *replicas, dbs, dbQueriers, placement)
+			if err != nil {
+				proxy.Logger.Printf("ERROR: shard rebalance: %v", err)
+			}
+			proxy.Logger.Printf("INFO: shard rebalance moved %d responses", moved)
+		}()
+	}
+	if *compress != "" {
+		writer, err = proxyhandler.NewCompressWriter(writer, *compress, *compressMinSize)
+		if err != nil {
+			log.Fatalf("invalid compress: %v", err)
+		}
+	}
+	writeQueue := storage.NewWriteQueue(writer, storage.QueueConfig{
+		Depth:     *writeQueueDepth,
+		Workers:   *writeWorkers,
+		BatchSize: *writeBatchSize,
+		Block:     *writeQueueBlock,
+	})
+	// the pending responses are stored before closing the databases
+	defer writeQueue.Close()
+	writer = writeQueue
+
+	if *metrics {
+		expvar.Publish("write_queue", writeQueue.Var())
+		if memoryCache != nil {
+			expvar.Publish("memory_cache", memoryCache.Var())
+		}
+		mux := http.NewServeMux()
+		mux.Handle("/debug/vars", expvar.Handler())
+		proxy.NonproxyHandler = mux
+	}
+
+	var responsePurger proxyhandler.ResponsePurger
+	if !*readOnly {
+		purger, err := storage.NewPurger(dbs)
+		if err != nil {
+			log.Fatalf("new purger: %v", err)
+		}
+		defer purger.Close()
+		responsePurger = purger
+		if memoryCache != nil {
+			responsePurger = memoryCache.Purger(purger)
+		}
+	}
+
 	proxy.OnRequest().Do(proxyhandler.NewRequestHandler(
 		proxyhandler.RequestConfig{
-			Querier:         repository,
+			Querier:         querier,
+			Key:             keyFunc,
+			Writer:          writer,
+			Purger:          responsePurger,
 			CacheableStatus: cacheableStatus,
 			TTL:             *ttl,
 			RFC9111:         *rfc9111,
 			SharedCache:     *shared,
 			ReadOnly:        *readOnly,
+			StaleIfError:    *staleIfError,
+			CachePOST:       cachePOSTPatterns,
+			CachePOSTHeader: *cachePOSTHeaders,
+			DisableRefresh:  *disableRefresh,
+			RewriteTTL:      *rewriteTTL,
+			Rules:           rules,
 			Verbose:         *verbose,
+
+			MaxObjectSize: maxObjectBytes,
 		},
 	))
 
 	if !*readOnly {
 		proxy.OnResponse().Do(proxyhandler.NewResponseHandler(
 			proxyhandler.ResponseConfig{
-				Writer:      repository,
+				Writer:      writer,
+				Purger:      responsePurger,
+				Key:         keyFunc,
 				RFC9111:     *rfc9111,
 				TTL:         *ttl,
 				SharedCache: *shared,
+				HeadUpdate:  *headUpdate,
+				CachePOST:   cachePOSTPatterns,
+				RewriteTTL:  *rewriteTTL,
+				Rules:       rules,
 				Verbose:     *verbose,
+
+				MaxObjectSize: maxObjectBytes,
 			},
 		))
 	}
 
+	if *cacheStatus {
+		proxy.OnResponse().Do(proxyhandler.NewCacheStatusHandler("sqlite-http-proxy"))
+	}
+
 	lis, err := net.Listen("tcp", fmt.Sprintf(":%d", *port))
 	if err != nil {
 		log.Fatalf("cannot open port %d: %v", port, err)
 	}
 
+	server := &http.Server{Handler: proxy}
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	shutdown := make(chan struct{})
+	go func() {
+		defer close(shutdown)
+		<-ctx.Done()
+		proxy.Logger.Printf("INFO: Shutting down...")
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		defer cancel()
+		if err := server.Shutdown(shutdownCtx); err != nil {
+			proxy.Logger.Printf("WARN: shutdown: %v", err)
+		}
+	}()
+
 	proxy.Logger.Printf("SQLite-HTTP-Proxy listening port=%d", *port)
-	log.Fatal(http.Serve(lis, proxy))
+	if err := server.Serve(lis); !errors.Is(err, http.ErrServerClosed) {
+		log.Fatal(err)
+	}
+	<-shutdown
 }
 
 func parseCA(caCert, caKey []byte) (*tls.Certificate, error) {
@@ -101,6 +101,9 @@ func main() {
 		tableList = *responseTables
 	}
 
+	// secondary keys (Vary variants, POST bodies and key headers after a "#"
+	// fragment) are not refreshed: a plain GET request of the URL cannot
+	// reproduce the request they were stored for
 	var (
 		fn            dataRefresher
 		queryTemplate string
@@ -109,12 +112,12 @@ func main() {
 		fn = refreshDataRFC9111
 		queryTemplate = fmt.Sprintf(`INSERT INTO temp.%%s_refresh(url) 
 			SELECT url FROM %%s
-			WHERE url LIKE ? AND cache_expired_ttl(header, request_time, response_time, %s, ?) = 1`, fmt.Sprint(*shared))
+			WHERE url LIKE ? AND url NOT LIKE '%%%%#%%%%' AND cache_expired_ttl(header, request_time, response_time, %s, ?) = 1`, fmt.Sprint(*shared))
 	} else {
 		fn = refreshDataTTL
 		queryTemplate = `INSERT INTO temp.%s_refresh(url) 
 		SELECT url FROM %s
-		WHERE url LIKE ? AND unixepoch() - unixepoch(response_time) > ?`
+		WHERE url LIKE ? AND url NOT LIKE '%%#%%' AND unixepoch() - unixepoch(response_time) > ?`
 	}
 
 	stmts := make(map[string]*sql.Stmt)
@@ -3,6 +3,7 @@ module github.com/walterwanderley/sqlite-http-cache
 go 1.24
 
 require (
+	github.com/BurntSushi/toml v1.5.0
 	github.com/elazarl/goproxy v1.7.2
 	github.com/elazarl/goproxy/ext v0.0.0-20250305112401-088f758167d2
 	github.com/litesql/httpcache v0.0.7
@@ -0,0 +1,155 @@
+package proxy
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/elazarl/goproxy"
+	"github.com/litesql/httpcache/db"
+)
+
+// forward reasons of the Cache-Status header (RFC 9211 section 2.2)
+const (
+	fwdBypass   = "bypass"
+	fwdMethod   = "method"
+	fwdURIMiss  = "uri-miss"
+	fwdVaryMiss = "vary-miss"
+	fwdMiss     = "miss"
+	fwdRequest  = "request"
+	fwdStale    = "stale"
+)
+
+// cacheStatus describes how the cache handled a request. It is reported to
+// the client in the Cache-Status header.
+type cacheStatus struct {
+	hit       bool
+	fwd       string
+	fwdStatus int
+	ttl       *int
+	stored    bool
+	key       string
+	detail    string
+}
+
+func newCacheStatus(key string) *cacheStatus {
+	return &cacheStatus{fwd: fwdBypass, key: key}
+}
+
+// served marks the request as satisfied by the stored response, with the
+// remaining freshness lifetime in seconds (negative when stale).
+func (s *cacheStatus) served(resp *db.Response, ttl *int) {
+	s.hit = true
+	s.fwd = ""
+	s.ttl = ttl
+	s.detail = storedAt(resp)
+}
+
+// forwarded records the status code of the origin response. It is a no-op
+// on a nil cacheStatus, used by background revalidations.
+func (s *cacheStatus) forwarded(status int) {
+	if s != nil && s.fwdStatus == 0 {
+		s.fwdStatus = status
+	}
+}
+
+func (s *cacheStatus) markStored() {
+	if s != nil {
+		s.stored = true
+	}
+}
+
+// String formats the entry of the Cache-Status list for the named cache
+func (s *cacheStatus) String(name string) string {
+	params := []string{name}
+	if s.hit {
+		params = append(params, "hit")
+	}
+	if s.fwd != "" {
+		params = append(params, "fwd="+s.fwd)
+		if s.fwdStatus > 0 {
+			params = append(params, fmt.Sprintf("fwd-status=%d", s.fwdStatus))
+		}
+	}
+	if s.ttl != nil {
+		params = append(params, fmt.Sprintf("ttl=%d", *s.ttl))
+	}
+	if s.stored {
+		params = append(params, "stored")
+	}
+	if s.key != "" {
+		params = append(params, "key="+quoteString(s.key))
+	}
+	if s.detail != "" {
+		params = append(params, "detail="+quoteString(s.detail))
+	}
+	return strings.Join(params, "; ")
+}
+
+// storedAt identifies the database and the table of a stored response
+func storedAt(resp *db.Response) string {
+	if resp == nil || resp.DatabaseID < 0 {
+		return ""
+	}
+	if resp.TableName == "" {
+		return fmt.Sprintf("db=%d", resp.DatabaseID)
+	}
+	return fmt.Sprintf("db=%d table=%s", resp.DatabaseID, resp.TableName)
+}
+
+// quoteString encodes a structured field string (RFC 8941 section 3.3.3)
+func quoteString(s string) string {
+	var b strings.Builder
+	b.WriteByte('"')
+	for _, c := range []byte(s) {
+		switch {
+		case c == '"' || c == '\\':
+			b.WriteByte('\\')
+			b.WriteByte(c)
+		case c < 0x20 || c > 0x7e:
+			fmt.Fprintf(&b, "%%%02x", c)
+		default:
+			b.WriteByte(c)
+		}
+	}
+	b.WriteByte('"')
+	return b.String()
+}
+
+type cacheStatusHandler struct {
+	name string
+}
+
+// NewCacheStatusHandler returns a response handler adding the Cache-Status
+// header (RFC 9211) to the responses. It must be registered after the
+// handler returned by NewResponseHandler.
+func NewCacheStatusHandler(name string) goproxy.RespHandler {
+	return &cacheStatusHandler{name: name}
+}
+
+func (h *cacheStatusHandler) Handle(resp *http.Response, ctx *goproxy.ProxyCtx) *http.Response {
+	if resp == nil {
+		return resp
+	}
+	var status *cacheStatus
+	switch ud := ctx.UserData.(type) {
+	case userData:
+		status = ud.status
+	case *cacheStatus:
+		status = ud
+	}
+	if status == nil {
+		return resp
+	}
+	if status.fwd != "" {
+		status.forwarded(resp.StatusCode)
+	}
+	// the header map may be shared with the response being stored
+	header := resp.Header.Clone()
+	if header == nil {
+		header = make(http.Header)
+	}
+	header.Add("Cache-Status", status.String(h.name))
+	resp.Header = header
+	return resp
+}
@@ -0,0 +1,205 @@
+package proxy
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/litesql/httpcache/db"
+	"github.com/walterwanderley/sqlite-http-cache/storage"
+)
+
+// storedEncodingHeader records the encoding applied by the proxy to the
+// stored body. The other headers describe the response sent by the origin.
+const storedEncodingHeader = "X-Stored-Content-Encoding"
+
+// incompressibleTypes are media types already compressed
+var incompressibleTypes = []string{"image/", "video/", "audio/", "font/woff", "application/zip", "application/gzip", "application/zstd", "application/x-7z-compressed", "application/x-rar-compressed"}
+
+// CompressWriter stores the response bodies compressed
+type CompressWriter struct {
+	next    ResponseWriter
+	minSize int
+}
+
+// NewCompressWriter returns a ResponseWriter compressing bodies of at least
+// minSize bytes before writing them with the next writer. Only the gzip
+// encoding is supported (zstd is not implemented).
+func NewCompressWriter(next ResponseWriter, encoding string, minSize int) (*CompressWriter, error) {
+	if encoding != "gzip" {
+		return nil, fmt.Errorf("unsupported encoding %q", encoding)
+	}
+	return &CompressWriter{
+		next:    next,
+		minSize: minSize,
+	}, nil
+}
+
+func (w *CompressWriter) Write(ctx context.Context, url string, resp *db.Response) error {
+	resp, err := w.compress(resp)
+	if err != nil {
+		return err
+	}
+	return w.next.Write(ctx, url, resp)
+}
+
+// WriteBatch compresses the bodies and writes the whole batch with a single
+// call when the next writer is a storage.BatchWriter.
+func (w *CompressWriter) WriteBatch(ctx context.Context, entries []storage.Entry) (int, error) {
+	batchWriter, ok := w.next.(storage.BatchWriter)
+	var (
+		written int
+		errs    error
+	)
+	compressed := make([]storage.Entry, 0, len(entries))
+	for _, entry := range entries {
+		resp, err := w.compress(entry.Response)
+		if err != nil {
+			errs = errors.Join(errs, fmt.Errorf("%s: %w", entry.URL, err))
+			continue
+		}
+		if ok {
+			compressed = append(compressed, storage.Entry{URL: entry.URL, Response: resp})
+			continue
+		}
+		err = w.next.Write(ctx, entry.URL, resp)
+		// writers from other packages may not close the body
+		resp.Body.Close()
+		if err != nil {
+			errs = errors.Join(errs, fmt.Errorf("%s: %w", entry.URL, err))
+			continue
+		}
+		written++
+	}
+	if len(compressed) > 0 {
+		n, err := batchWriter.WriteBatch(ctx, compressed)
+		written += n
+		errs = errors.Join(errs, err)
+	}
+	return written, errs
+}
+
+// compress returns the response with its body compressed, or resp when it is
+// already encoded, not compressible or smaller than minSize.
+func (w *CompressWriter) compress(resp *db.Response) (*db.Response, error) {
+	header := http.Header(resp.Header)
+	if header.Get("Content-Encoding") != "" || header.Get(storedEncodingHeader) != "" || !compressible(header.Get("Content-Type")) {
+		return resp, nil
+	}
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return nil, fmt.Errorf("reading body: %w", err)
+	}
+	if len(body) < w.minSize {
+		resp.Body = io.NopCloser(bytes.NewReader(body))
+		return resp, nil
+	}
+
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	zw.Write(body)
+	if err := zw.Close(); err != nil {
+		return nil, fmt.Errorf("compressing body: %w", err)
+	}
+	compressed := *resp
+	// the header map can be shared with the response sent to the client
+	compressed.Header = header.Clone()
+	http.Header(compressed.Header).Set(storedEncodingHeader, "gzip")
+	compressed.Body = io.NopCloser(&buf)
+	return &compressed, nil
+}
+
+func compressible(contentType string) bool {
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	for _, prefix := range incompressibleTypes {
+		if strings.HasPrefix(mediaType, prefix) {
+			return false
+		}
+	}
+	return true
+}
+
+// decodeStored replaces the compressed body of the stored response by the original body
+func decodeStored(resp *db.Response) error {
+	header := http.Header(resp.Header)
+	if header.Get(storedEncodingHeader) == "" {
+		return nil
+	}
+	header.Del(storedEncodingHeader)
+	zr, err := gzip.NewReader(resp.Body)
+	if err != nil {
+		resp.Body.Close()
+		resp.Body = io.NopCloser(strings.NewReader(""))
+		return fmt.Errorf("decoding stored body: %w", err)
+	}
+	resp.Body = readCloser{zr, resp.Body}
+	return nil
+}
+
+// acceptsEncoded reports whether the compressed stored body can be sent as
+// is to the client.
+func acceptsEncoded(r *http.Request, header http.Header) bool {
+	return header.Get(storedEncodingHeader) != "" && r.Header.Get("Range") == "" && acceptsGzip(r.Header)
+}
+
+// serveEncoded prepares the headers to send the compressed stored body as is.
+func serveEncoded(header http.Header) {
+	header.Del(storedEncodingHeader)
+	header.Del("Content-Length")
+	header.Set("Content-Encoding", "gzip")
+	weakETag(header)
+}
+
+// weakETag marks the ETag as weak, the compressed body is another
+// representation (RFC 9110 section 8.8.3). It is applied to the 200 and 304
+// responses sent to the clients receiving the compressed body.
+func weakETag(header http.Header) {
+	if etag := header.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+		header.Set("ETag", "W/"+etag)
+	}
+}
+
+// varyEncoding adds Accept-Encoding to the Vary header of a response built
+// from an entry compressed by the proxy: the encoded or decoded body sent
+// depends on the request.
+func varyEncoding(header http.Header) {
+	fields := varyFields(header)
+	if slices.Contains(fields, "Accept-Encoding") || slices.Contains(fields, "*") {
+		return
+	}
+	header.Add("Vary", "Accept-Encoding")
+}
+
+// acceptsGzip evaluates the Accept-Encoding request header (RFC 9110 section 12.5.3)
+func acceptsGzip(header http.Header) bool {
+	accepted := false
+	for _, value := range header.Values("Accept-Encoding") {
+		for _, item := range strings.Split(value, ",") {
+			coding, params, _ := strings.Cut(strings.TrimSpace(item), ";")
+			coding = strings.ToLower(strings.TrimSpace(coding))
+			if coding != "gzip" && coding != "x-gzip" && coding != "*" {
+				continue
+			}
+			q := 1.0
+			if name, value, found := strings.Cut(strings.TrimSpace(params), "="); found && strings.TrimSpace(name) == "q" {
+				if v, err := strconv.ParseFloat(strings.TrimSpace(value), 64); err == nil {
+					q = v
+				}
+			}
+			if coding != "*" {
+				return q > 0
+			}
+			accepted = q > 0
+		}
+	}
+	return accepted
+}
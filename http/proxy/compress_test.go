@@ -0,0 +1,89 @@
+package proxy
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/litesql/httpcache/db"
+	"github.com/walterwanderley/sqlite-http-cache/storage"
+)
+
+// batchRecorder records the batches written. The first batch waits for
+// release, so the next responses are queued meanwhile.
+type batchRecorder struct {
+	mu      sync.Mutex
+	batches [][]storage.Entry
+	started chan struct{}
+	release chan struct{}
+}
+
+func (r *batchRecorder) Write(ctx context.Context, url string, resp *db.Response) error {
+	_, err := r.WriteBatch(ctx, []storage.Entry{{URL: url, Response: resp}})
+	return err
+}
+
+func (r *batchRecorder) WriteBatch(ctx context.Context, entries []storage.Entry) (int, error) {
+	r.mu.Lock()
+	r.batches = append(r.batches, entries)
+	first := len(r.batches) == 1
+	r.mu.Unlock()
+	if first {
+		close(r.started)
+		<-r.release
+	}
+	for _, entry := range entries {
+		entry.Response.Body.Close()
+	}
+	return len(entries), nil
+}
+
+func TestCompressWriterQueueBatch(t *testing.T) {
+	recorder := &batchRecorder{
+		started: make(chan struct{}),
+		release: make(chan struct{}),
+	}
+	writer, err := NewCompressWriter(recorder, "gzip", 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	queue := storage.NewWriteQueue(writer, storage.QueueConfig{Depth: 100, Workers: 1, BatchSize: 100})
+
+	write := func(i int) {
+		resp := &db.Response{
+			Status: http.StatusOK,
+			Header: map[string][]string{"Content-Type": {"text/plain"}},
+			Body:   io.NopCloser(strings.NewReader(strings.Repeat("hello world ", 100))),
+		}
+		if err := queue.Write(context.Background(), "http://example.com/"+strconv.Itoa(i), resp); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write(0)
+	<-recorder.started
+	const pending = 20
+	for i := 1; i <= pending; i++ {
+		write(i)
+	}
+	close(recorder.release)
+	if err := queue.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(recorder.batches) != 2 {
+		t.Fatalf("got %d batches, want 2", len(recorder.batches))
+	}
+	batch := recorder.batches[1]
+	if len(batch) != pending {
+		t.Fatalf("got %d responses in the second batch, want %d", len(batch), pending)
+	}
+	for _, entry := range batch {
+		if encoding := http.Header(entry.Response.Header).Get(storedEncodingHeader); encoding != "gzip" {
+			t.Errorf("%s: stored encoding %q, want gzip", entry.URL, encoding)
+		}
+	}
+}
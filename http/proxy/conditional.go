@@ -0,0 +1,107 @@
+package proxy
+
+import (
+	"io"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+)
+
+// evalPreconditions evaluates the client preconditions against the stored
+// response following the order defined by RFC 9110 section 13.2.2.
+// It returns 0 when the stored response must be served as is, or the status
+// code (304 or 412) to reply instead.
+func evalPreconditions(r *http.Request, status int, header http.Header) int {
+	if status < 200 || status > 299 {
+		// preconditions are ignored when the response would not be 2xx
+		return 0
+	}
+	etag := header.Get("ETag")
+	lastModified, hasLastModified := parseHTTPDate(header.Get("Last-Modified"))
+
+	if ifMatch := r.Header.Get("If-Match"); ifMatch != "" {
+		if !matchETag(ifMatch, etag, false) {
+			return http.StatusPreconditionFailed
+		}
+	} else if t, ok := parseHTTPDate(r.Header.Get("If-Unmodified-Since")); ok {
+		if !hasLastModified || lastModified.After(t) {
+			return http.StatusPreconditionFailed
+		}
+	}
+
+	safe := r.Method == http.MethodGet || r.Method == http.MethodHead
+	if ifNoneMatch := r.Header.Get("If-None-Match"); ifNoneMatch != "" {
+		if matchETag(ifNoneMatch, etag, true) {
+			if safe {
+				return http.StatusNotModified
+			}
+			return http.StatusPreconditionFailed
+		}
+	} else if t, ok := parseHTTPDate(r.Header.Get("If-Modified-Since")); ok && safe {
+		if hasLastModified && !lastModified.After(t) {
+			return http.StatusNotModified
+		}
+	}
+	return 0
+}
+
+// matchETag reports whether the entity-tag matches any tag of the list
+// using the weak or the strong comparison function (RFC 9110 section 8.8.3.2).
+// The list "*" matches any current representation: preconditions are only
+// evaluated against a stored response, so it always matches, with or without
+// entity-tag.
+func matchETag(list string, etag string, weak bool) bool {
+	list = strings.TrimSpace(list)
+	if list == "*" {
+		return true
+	}
+	if etag == "" {
+		return false
+	}
+	for _, tag := range strings.Split(list, ",") {
+		tag = strings.TrimSpace(tag)
+		if weak {
+			if strings.TrimPrefix(tag, "W/") == strings.TrimPrefix(etag, "W/") {
+				return true
+			}
+			continue
+		}
+		if !strings.HasPrefix(tag, "W/") && !strings.HasPrefix(etag, "W/") && tag == etag {
+			return true
+		}
+	}
+	return false
+}
+
+func parseHTTPDate(value string) (time.Time, bool) {
+	if value == "" {
+		return time.Time{}, false
+	}
+	t, err := http.ParseTime(value)
+	return t, err == nil
+}
+
+// notModifiedHeaders are the fields sent in a 304 (Not Modified) response (RFC 9110 section 15.4.5)
+var notModifiedHeaders = []string{"Cache-Control", "Content-Location", "Date", "ETag", "Expires", "Last-Modified", "Vary", "Age"}
+
+// preconditionResponse builds the 304 (Not Modified) or 412 (Precondition Failed) response without body.
+func preconditionResponse(r *http.Request, status int, header http.Header) *http.Response {
+	respHeader := make(http.Header)
+	if status == http.StatusNotModified {
+		for _, name := range notModifiedHeaders {
+			if values := header.Values(name); len(values) > 0 {
+				respHeader[name] = slices.Clone(values)
+			}
+		}
+	} else {
+		respHeader.Set("Date", header.Get("Date"))
+	}
+	return &http.Response{
+		StatusCode: status,
+		Status:     statusLine(status),
+		Header:     respHeader,
+		Body:       io.NopCloser(strings.NewReader("")),
+		Request:    r,
+	}
+}
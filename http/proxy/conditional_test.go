@@ -0,0 +1,95 @@
+package proxy
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestEvalPreconditions(t *testing.T) {
+	stored := http.Header{
+		"Etag":          {`"v1"`},
+		"Last-Modified": {"Mon, 02 Jan 2006 15:04:05 GMT"},
+	}
+	tests := []struct {
+		name   string
+		method string
+		header map[string]string
+		status int
+		want   int
+	}{
+		{"no preconditions", http.MethodGet, nil, http.StatusOK, 0},
+		{"if-none-match", http.MethodGet, map[string]string{"If-None-Match": `"v1"`}, http.StatusOK, http.StatusNotModified},
+		{"if-none-match weak", http.MethodGet, map[string]string{"If-None-Match": `"v0", W/"v1"`}, http.StatusOK, http.StatusNotModified},
+		{"if-none-match star", http.MethodHead, map[string]string{"If-None-Match": "*"}, http.StatusOK, http.StatusNotModified},
+		{"if-none-match mismatch", http.MethodGet, map[string]string{"If-None-Match": `"v2"`}, http.StatusOK, 0},
+		{"if-none-match unsafe", http.MethodPost, map[string]string{"If-None-Match": `"v1"`}, http.StatusOK, http.StatusPreconditionFailed},
+		{"if-match", http.MethodGet, map[string]string{"If-Match": `"v1"`}, http.StatusOK, 0},
+		{"if-match star", http.MethodGet, map[string]string{"If-Match": "*"}, http.StatusOK, 0},
+		{"if-match mismatch", http.MethodGet, map[string]string{"If-Match": `"v2"`}, http.StatusOK, http.StatusPreconditionFailed},
+		{"if-match weak", http.MethodGet, map[string]string{"If-Match": `W/"v1"`}, http.StatusOK, http.StatusPreconditionFailed},
+		{"if-modified-since", http.MethodGet, map[string]string{"If-Modified-Since": "Mon, 02 Jan 2006 15:04:05 GMT"}, http.StatusOK, http.StatusNotModified},
+		{"if-modified-since older", http.MethodGet, map[string]string{"If-Modified-Since": "Sun, 01 Jan 2006 15:04:05 GMT"}, http.StatusOK, 0},
+		{"if-none-match precedence", http.MethodGet, map[string]string{"If-None-Match": `"v2"`, "If-Modified-Since": "Mon, 02 Jan 2006 15:04:05 GMT"}, http.StatusOK, 0},
+		{"if-unmodified-since", http.MethodGet, map[string]string{"If-Unmodified-Since": "Mon, 02 Jan 2006 15:04:05 GMT"}, http.StatusOK, 0},
+		{"if-unmodified-since older", http.MethodGet, map[string]string{"If-Unmodified-Since": "Sun, 01 Jan 2006 15:04:05 GMT"}, http.StatusOK, http.StatusPreconditionFailed},
+		{"not 2xx", http.MethodGet, map[string]string{"If-None-Match": `"v1"`}, http.StatusNotFound, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(tt.method, "http://example.com/", nil)
+			for name, value := range tt.header {
+				r.Header.Set(name, value)
+			}
+			if got := evalPreconditions(r, tt.status, stored); got != tt.want {
+				t.Errorf("got %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMatchETagWithoutStoredETag(t *testing.T) {
+	if !matchETag("*", "", true) {
+		t.Error(`"*" did not match a stored response without entity-tag`)
+	}
+	if matchETag(`"v1"`, "", true) {
+		t.Error("entity-tag matched a stored response without entity-tag")
+	}
+}
+
+func TestConditionalHit(t *testing.T) {
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("ETag", `"v1"`)
+		w.Header().Set("Last-Modified", "Mon, 02 Jan 2006 15:04:05 GMT")
+		fmt.Fprint(w, "hello")
+	}))
+	defer origin.Close()
+
+	for _, rfc9111 := range []bool{false, true} {
+		t.Run(fmt.Sprintf("rfc9111=%t", rfc9111), func(t *testing.T) {
+			p := newTestProxy(t, RequestConfig{RFC9111: rfc9111, TTL: 100}, ResponseConfig{RFC9111: rfc9111, TTL: 100})
+			p.get(origin.URL+"/x", nil)
+
+			resp, body := p.get(origin.URL+"/x", map[string]string{"If-None-Match": `W/"v1"`})
+			if resp.StatusCode != http.StatusNotModified || body != "" {
+				t.Errorf("If-None-Match: got %d %q, want 304 without body", resp.StatusCode, body)
+			}
+			if got := resp.Header.Get("ETag"); got != `"v1"` {
+				t.Errorf("304 ETag %q, want %q", got, `"v1"`)
+			}
+			resp, _ = p.get(origin.URL+"/x", map[string]string{"If-Match": `"v2"`})
+			if resp.StatusCode != http.StatusPreconditionFailed {
+				t.Errorf("If-Match: got %d, want 412", resp.StatusCode)
+			}
+			resp, _ = p.get(origin.URL+"/x", map[string]string{"If-Modified-Since": "Mon, 02 Jan 2006 15:04:05 GMT"})
+			if resp.StatusCode != http.StatusNotModified {
+				t.Errorf("If-Modified-Since: got %d, want 304", resp.StatusCode)
+			}
+			resp, body = p.get(origin.URL+"/x", map[string]string{"If-None-Match": `"v2"`})
+			if resp.StatusCode != http.StatusOK || body != "hello" {
+				t.Errorf("If-None-Match mismatch: got %d %q, want 200 hello", resp.StatusCode, body)
+			}
+		})
+	}
+}
@@ -0,0 +1,35 @@
+package proxy
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// rewriteFreshness replaces the max-age and s-maxage directives and the
+// Expires header, so downstream caches consider the response fresh for the
+// remaining seconds. The max-age accounts for the Age header of the response.
+func rewriteFreshness(header http.Header, remaining int) {
+	remaining = max(remaining, 0)
+	age, err := strconv.Atoi(header.Get("Age"))
+	if err != nil || age < 0 {
+		age = 0
+	}
+	directives := make([]string, 0)
+	for _, value := range header.Values("Cache-Control") {
+		for _, d := range strings.Split(value, ",") {
+			d = strings.TrimSpace(d)
+			name, _, _ := strings.Cut(d, "=")
+			name = strings.ToLower(strings.TrimSpace(name))
+			if name == "" || name == "max-age" || name == "s-maxage" {
+				continue
+			}
+			directives = append(directives, d)
+		}
+	}
+	directives = append(directives, fmt.Sprintf("max-age=%d", remaining+age))
+	header.Set("Cache-Control", strings.Join(directives, ", "))
+	header.Set("Expires", time.Now().Add(time.Duration(remaining)*time.Second).UTC().Format(http.TimeFormat))
+}
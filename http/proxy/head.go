@@ -0,0 +1,28 @@
+package proxy
+
+import (
+	"net/http"
+	"strconv"
+)
+
+// headMatches reports whether the response to a HEAD request describes the
+// stored response, so it can be used to update the stored headers and
+// freshness (RFC 9111 section 4.3.5).
+func headMatches(stored *storedResponse, resp *http.Response) bool {
+	if resp.StatusCode != stored.status {
+		return false
+	}
+	etag := resp.Header.Get("ETag")
+	storedETag := stored.header.Get("ETag")
+	if etag != "" || storedETag != "" {
+		if etag != storedETag {
+			return false
+		}
+	} else if resp.Header.Get("Last-Modified") != stored.header.Get("Last-Modified") {
+		return false
+	}
+	if contentLength := resp.Header.Get("Content-Length"); contentLength != "" && contentLength != strconv.Itoa(len(stored.body)) {
+		return false
+	}
+	return true
+}
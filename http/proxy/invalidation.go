@@ -0,0 +1,54 @@
+package proxy
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+)
+
+// isSafe reports whether the request method is safe (RFC 9110 section 9.2.1)
+func isSafe(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace:
+		return true
+	default:
+		return false
+	}
+}
+
+// invalidate purges the stored responses of the target URI and of the
+// Location and Content-Location URIs (when they have the same origin) after
+// a non-error response to an unsafe request (RFC 9111 section 4.4).
+func invalidate(purger ResponsePurger, key KeyFunc, req *http.Request, resp *http.Response, verbose bool) {
+	if purger == nil || resp.StatusCode < 200 || resp.StatusCode > 399 {
+		return
+	}
+	urls := []string{keyOf(key, req.URL)}
+	for _, name := range []string{"Location", "Content-Location"} {
+		value := resp.Header.Get(name)
+		if value == "" {
+			continue
+		}
+		u, err := req.URL.Parse(value)
+		if err != nil || u.Scheme != req.URL.Scheme || u.Host != req.URL.Host {
+			continue
+		}
+		urls = append(urls, keyOf(key, u))
+	}
+	for _, url := range urls {
+		if verbose {
+			slog.Info("invalidating stored response", "url", url, "method", req.Method, "status", resp.StatusCode)
+		}
+		purge(purger, url)
+	}
+}
+
+// purge deletes the stored entries of the URL, including its secondary keys
+func purge(purger ResponsePurger, url string) {
+	if purger == nil {
+		return
+	}
+	if err := purger.Purge(context.Background(), url); err != nil {
+		slog.Error("invalidating stored response", "error", err, "url", url)
+	}
+}
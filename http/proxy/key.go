@@ -0,0 +1,118 @@
+package proxy
+
+import (
+	"net"
+	"net/http"
+	neturl "net/url"
+	"slices"
+	"strings"
+)
+
+// KeyFunc returns the cache key of a request. The key must be the request URL
+// (or an equivalent URL), optionally followed by a fragment identifying
+// a variant, so the stored responses of an URL can be purged together.
+type KeyFunc func(r *http.Request) string
+
+// URLKey is the default KeyFunc: the request URL as is
+func URLKey(r *http.Request) string {
+	return r.URL.String()
+}
+
+// KeyConfig configures the URL normalization of NewKeyFunc
+type KeyConfig struct {
+	SortQuery       bool
+	StripParams     []string // query parameters removed from the key, a trailing * matches a prefix (utm_*)
+	LowercaseHost   bool
+	DropDefaultPort bool
+	Headers         []string // request headers included in the key
+}
+
+// NewKeyFunc returns a KeyFunc normalizing the request URL, so equivalent
+// URLs share the same stored response.
+func NewKeyFunc(config KeyConfig) KeyFunc {
+	headers := make([]string, 0, len(config.Headers))
+	for _, name := range config.Headers {
+		name = http.CanonicalHeaderKey(strings.TrimSpace(name))
+		if name != "" && !slices.Contains(headers, name) {
+			headers = append(headers, name)
+		}
+	}
+	slices.Sort(headers)
+
+	return func(r *http.Request) string {
+		u := *r.URL
+		u.Fragment = ""
+		u.RawFragment = ""
+		if config.LowercaseHost {
+			u.Host = strings.ToLower(u.Host)
+		}
+		if config.DropDefaultPort {
+			if host, port, err := net.SplitHostPort(u.Host); err == nil &&
+				((u.Scheme == "http" && port == "80") || (u.Scheme == "https" && port == "443")) {
+				u.Host = host
+				if strings.Contains(host, ":") {
+					u.Host = "[" + host + "]"
+				}
+			}
+		}
+		if u.RawQuery != "" && (config.SortQuery || len(config.StripParams) > 0) {
+			u.RawQuery = normalizeQuery(u.RawQuery, config.SortQuery, config.StripParams)
+			u.ForceQuery = false
+		}
+		key := u.String()
+
+		values := make(neturl.Values)
+		for _, name := range headers {
+			if v := r.Header.Values(name); len(v) > 0 {
+				values.Set(strings.ToLower(name), normalizeHeaderValues(v))
+			}
+		}
+		if len(values) > 0 {
+			key += "#header:" + values.Encode()
+		}
+		return key
+	}
+}
+
+// normalizeQuery removes the stripped parameters and sorts the remaining
+// ones by name, keeping the order of repeated parameters. Parameters are
+// separated by "&" only: ";" is part of the value, as in net/url since Go 1.17.
+func normalizeQuery(rawQuery string, sortQuery bool, strip []string) string {
+	params := strings.FieldsFunc(rawQuery, func(r rune) bool {
+		return r == '&'
+	})
+	params = slices.DeleteFunc(params, func(param string) bool {
+		name, _, _ := strings.Cut(param, "=")
+		if unescaped, err := neturl.QueryUnescape(name); err == nil {
+			name = unescaped
+		}
+		return stripParam(name, strip)
+	})
+	if sortQuery {
+		slices.SortStableFunc(params, func(a, b string) int {
+			nameA, _, _ := strings.Cut(a, "=")
+			nameB, _, _ := strings.Cut(b, "=")
+			return strings.Compare(nameA, nameB)
+		})
+	}
+	return strings.Join(params, "&")
+}
+
+func stripParam(name string, strip []string) bool {
+	for _, pattern := range strip {
+		if prefix, ok := strings.CutSuffix(pattern, "*"); ok {
+			if strings.HasPrefix(name, prefix) {
+				return true
+			}
+		} else if name == pattern {
+			return true
+		}
+	}
+	return false
+}
+
+// keyOf returns the key of the URL without the request headers, covering
+// every stored variant of the URL when used to purge.
+func keyOf(key KeyFunc, u *neturl.URL) string {
+	return key(&http.Request{Method: http.MethodGet, URL: u, Header: make(http.Header), Host: u.Host})
+}
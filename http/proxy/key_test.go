@@ -0,0 +1,94 @@
+package proxy
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync/atomic"
+	"testing"
+)
+
+func TestNewKeyFunc(t *testing.T) {
+	key := NewKeyFunc(KeyConfig{
+		SortQuery:       true,
+		StripParams:     []string{"utm_*", "fbclid"},
+		LowercaseHost:   true,
+		DropDefaultPort: true,
+		Headers:         []string{"x-tenant", "X-Tenant", " Accept-Language "},
+	})
+	tests := []struct {
+		url    string
+		header map[string]string
+		want   string
+	}{
+		{"http://example.com/p", nil, "http://example.com/p"},
+		{"HTTP://Example.COM:80/p?z=1&a=2&utm_source=x&fbclid=y", nil, "http://example.com/p?a=2&z=1"},
+		{"https://example.com:443/p", nil, "https://example.com/p"},
+		{"https://example.com:8443/p", nil, "https://example.com:8443/p"},
+		{"http://[::1]:80/p", nil, "http://[::1]/p"},
+		{"http://example.com/p?b=2&a=1&b=1", nil, "http://example.com/p?a=1&b=2&b=1"},
+		{"http://example.com/p?utm_source=x", nil, "http://example.com/p"},
+		{"http://example.com/p?a=1;b=2", nil, "http://example.com/p?a=1;b=2"},
+		{"http://example.com/p#section", nil, "http://example.com/p"},
+		{"http://example.com/p", map[string]string{"X-Tenant": "t1"}, "http://example.com/p#header:x-tenant=t1"},
+		{"http://example.com/p", map[string]string{"X-Tenant": "t1", "Accept-Language": "en"}, "http://example.com/p#header:accept-language=en&x-tenant=t1"},
+	}
+	for _, tt := range tests {
+		r, err := http.NewRequest(http.MethodGet, tt.url, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for name, value := range tt.header {
+			r.Header.Set(name, value)
+		}
+		if got := key(r); got != tt.want {
+			t.Errorf("key(%s, %v) = %q, want %q", tt.url, tt.header, got, tt.want)
+		}
+	}
+}
+
+func TestNormalizeQuerySemicolon(t *testing.T) {
+	if got := normalizeQuery("b=1;a=2&a=1", true, nil); got != "a=1&b=1;a=2" {
+		t.Errorf("got %q, want %q", got, "a=1&b=1;a=2")
+	}
+	if got := normalizeQuery("a=1;utm_source=x", false, []string{"utm_*"}); got != "a=1;utm_source=x" {
+		t.Errorf("got %q, want the value kept as is", got)
+	}
+}
+
+func TestKeyOf(t *testing.T) {
+	key := NewKeyFunc(KeyConfig{SortQuery: true, Headers: []string{"X-Tenant"}})
+	u, err := url.Parse("http://example.com/p?b=2&a=1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := keyOf(key, u); got != "http://example.com/p?a=1&b=2" {
+		t.Errorf("got %q, want the key without headers", got)
+	}
+}
+
+func TestKeyFuncCache(t *testing.T) {
+	var hits atomic.Int32
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "%d %s", hits.Add(1), r.URL.RawQuery)
+	}))
+	defer origin.Close()
+	key := NewKeyFunc(KeyConfig{SortQuery: true, StripParams: []string{"utm_*"}})
+	p := newTestProxy(t, RequestConfig{TTL: 600, Key: key}, ResponseConfig{TTL: 600, Key: key})
+
+	if _, body := p.get(origin.URL+"/x?b=2&a=1&utm_source=x", nil); body != "1 b=2&a=1&utm_source=x" {
+		t.Errorf("miss: got %q, want the origin response to the original URL", body)
+	}
+	if _, body := p.get(origin.URL+"/x?a=1&b=2", nil); body != "1 b=2&a=1&utm_source=x" {
+		t.Errorf("normalized URL: got %q, want the stored response", body)
+	}
+	if n := p.stored(origin.URL + "/x?a=1&b=2"); n != 1 {
+		t.Errorf("%d responses stored with the normalized key, want 1", n)
+	}
+
+	p.do(http.MethodPut, origin.URL+"/x?b=2&a=1", nil, nil)
+	if n := p.stored(origin.URL + "/x?a=1&b=2"); n != 0 {
+		t.Errorf("%d responses stored after PUT, want 0", n)
+	}
+}
@@ -0,0 +1,94 @@
+package proxy
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"mime"
+	"net/http"
+	neturl "net/url"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+// maxPOSTBodySize is the maximum size of a POST request body used as cache key, larger requests are not cached
+const maxPOSTBodySize = 10 << 20
+
+func matchAny(patterns []*regexp.Regexp, url string) bool {
+	return slices.ContainsFunc(patterns, func(re *regexp.Regexp) bool {
+		return re.MatchString(url)
+	})
+}
+
+// cacheablePOST reports whether the request is a POST to an URL configured to be cached
+func cacheablePOST(r *http.Request, patterns []*regexp.Regexp) bool {
+	return r.Method == http.MethodPost && matchAny(patterns, r.URL.String())
+}
+
+// postKey returns the cache key of a POST request to an URL matching one of
+// the patterns. The key is the request key followed by a hash of the
+// normalized request body and of the selected request headers. The request
+// body is restored to be sent to the origin.
+func postKey(r *http.Request, key string, patterns []*regexp.Regexp, headers []string) (string, bool) {
+	if !cacheablePOST(r, patterns) {
+		return "", false
+	}
+	var body []byte
+	if r.Body != nil {
+		var err error
+		body, err = io.ReadAll(io.LimitReader(r.Body, maxPOSTBodySize+1))
+		if err != nil || len(body) > maxPOSTBodySize {
+			r.Body = readCloser{io.MultiReader(bytes.NewReader(body), r.Body), r.Body}
+			return "", false
+		}
+		r.Body.Close()
+	}
+	r.Body = io.NopCloser(bytes.NewReader(body))
+	r.GetBody = func() (io.ReadCloser, error) {
+		return io.NopCloser(bytes.NewReader(body)), nil
+	}
+
+	hash := sha256.New()
+	hash.Write(normalizeBody(r.Header.Get("Content-Type"), body))
+	for _, name := range headers {
+		hash.Write([]byte("\n" + strings.ToLower(name) + ":" + normalizeHeaderValues(r.Header.Values(name))))
+	}
+	return key + "#body:" + hex.EncodeToString(hash.Sum(nil)), true
+}
+
+// normalizeBody returns a canonical form of JSON (sorted keys, no
+// insignificant whitespace) and form bodies, so equivalent requests share
+// the same cache key.
+func normalizeBody(contentType string, body []byte) []byte {
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	switch {
+	case mediaType == "application/json" || strings.HasSuffix(mediaType, "+json"):
+		dec := json.NewDecoder(bytes.NewReader(body))
+		dec.UseNumber()
+		var v any
+		if err := dec.Decode(&v); err != nil {
+			return body
+		}
+		normalized, err := json.Marshal(v)
+		if err != nil {
+			return body
+		}
+		return normalized
+	case mediaType == "application/x-www-form-urlencoded":
+		values, err := neturl.ParseQuery(string(body))
+		if err != nil {
+			return body
+		}
+		return []byte(values.Encode())
+	default:
+		return body
+	}
+}
+
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
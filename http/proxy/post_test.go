@@ -0,0 +1,107 @@
+package proxy
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+func TestNormalizeBody(t *testing.T) {
+	tests := []struct {
+		contentType string
+		body        string
+		want        string
+	}{
+		{"application/json", `{"b": 2, "a": [1, {"d": 1, "c": 2}]}`, `{"a":[1,{"c":2,"d":1}],"b":2}`},
+		{"application/graphql+json; charset=utf-8", `{ "query": "{ x }" }`, `{"query":"{ x }"}`},
+		{"application/json", `{"n": 12345678901234567890}`, `{"n":12345678901234567890}`},
+		{"application/json", `{invalid`, `{invalid`},
+		{"application/x-www-form-urlencoded", "b=2&a=1&a=0", "a=1&a=0&b=2"},
+		{"text/plain", "b=2&a=1", "b=2&a=1"},
+	}
+	for _, tt := range tests {
+		if got := normalizeBody(tt.contentType, []byte(tt.body)); string(got) != tt.want {
+			t.Errorf("normalizeBody(%q, %q) = %q, want %q", tt.contentType, tt.body, got, tt.want)
+		}
+	}
+}
+
+func TestPostKey(t *testing.T) {
+	patterns := []*regexp.Regexp{regexp.MustCompile("/graphql$")}
+	key := func(url, contentType, body string, header map[string]string) (string, bool) {
+		t.Helper()
+		r := httptest.NewRequest(http.MethodPost, url, strings.NewReader(body))
+		r.Header.Set("Content-Type", contentType)
+		for name, value := range header {
+			r.Header.Set(name, value)
+		}
+		k, ok := postKey(r, url, patterns, []string{"Authorization"})
+		// the body must still be sent to the origin
+		if sent, _ := io.ReadAll(r.Body); string(sent) != body {
+			t.Errorf("got request body %q, want %q", sent, body)
+		}
+		return k, ok
+	}
+
+	a, ok := key("http://example.com/graphql", "application/json", `{"a":1, "b":2}`, nil)
+	if !ok {
+		t.Fatal("POST to a configured URL not cacheable")
+	}
+	if !strings.HasPrefix(a, "http://example.com/graphql#body:") {
+		t.Errorf("got key %q, want the URL followed by the body hash", a)
+	}
+	if b, _ := key("http://example.com/graphql", "application/json", `{"b":2,"a":1}`, nil); b != a {
+		t.Errorf("equivalent JSON bodies got different keys %q and %q", a, b)
+	}
+	if c, _ := key("http://example.com/graphql", "application/json", `{"a":2}`, nil); c == a {
+		t.Errorf("different bodies got the same key %q", c)
+	}
+	if d, _ := key("http://example.com/graphql", "application/json", `{"a":1,"b":2}`, map[string]string{"Authorization": "t1"}); d == a {
+		t.Errorf("different key headers got the same key %q", d)
+	}
+	if _, ok := key("http://example.com/other", "application/json", `{"a":1}`, nil); ok {
+		t.Error("POST to an URL not configured is cacheable")
+	}
+}
+
+func TestPOSTCache(t *testing.T) {
+	var hits atomic.Int32
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := hits.Add(1)
+		body, _ := io.ReadAll(r.Body)
+		w.Header().Set("Cache-Control", "max-age=100")
+		fmt.Fprintf(w, "%d %s", n, body)
+	}))
+	defer origin.Close()
+	patterns := []*regexp.Regexp{regexp.MustCompile("/graphql$")}
+
+	for _, rfc9111 := range []bool{false, true} {
+		t.Run(fmt.Sprintf("rfc9111=%t", rfc9111), func(t *testing.T) {
+			hits.Store(0)
+			p := newTestProxy(t, RequestConfig{RFC9111: rfc9111, TTL: 100, CachePOST: patterns}, ResponseConfig{RFC9111: rfc9111, TTL: 100, CachePOST: patterns})
+			post := func(path, body string) string {
+				_, got := p.do(http.MethodPost, origin.URL+path, map[string]string{"Content-Type": "application/json"}, strings.NewReader(body))
+				return got
+			}
+
+			if got := post("/graphql", `{"a":1, "b":2}`); got != `1 {"a":1, "b":2}` {
+				t.Errorf("miss: got %q", got)
+			}
+			if got := post("/graphql", `{"b":2,"a":1}`); got != `1 {"a":1, "b":2}` {
+				t.Errorf("equivalent body: got %q, want the stored response", got)
+			}
+			if got := post("/graphql", `{"a":2}`); got != `2 {"a":2}` {
+				t.Errorf("different body: got %q, want a new response", got)
+			}
+			post("/other", `{"a":1}`)
+			if got := post("/other", `{"a":1}`); got != `4 {"a":1}` {
+				t.Errorf("URL not configured: got %q, want a new response", got)
+			}
+		})
+	}
+}
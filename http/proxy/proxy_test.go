@@ -0,0 +1,124 @@
+package proxy
+
+import (
+	"database/sql"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/elazarl/goproxy"
+	"github.com/litesql/httpcache/config"
+	"github.com/litesql/httpcache/db"
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/walterwanderley/sqlite-http-cache/storage"
+)
+
+// storeDelay is the time given to the proxy to store a response after its
+// body was sent to the client
+const storeDelay = 100 * time.Millisecond
+
+type testProxy struct {
+	t      *testing.T
+	client *http.Client
+	repo   db.Repository
+	sqlDB  *sql.DB
+}
+
+// newTestProxy starts a proxy storing the responses in a temporary database.
+// Unset queriers, writers and purgers of the configs use the database.
+func newTestProxy(t *testing.T, reqConfig RequestConfig, respConfig ResponseConfig) *testProxy {
+	t.Helper()
+	sqlDB, err := sql.Open("sqlite3", "file:"+filepath.Join(t.TempDir(), "test.db")+"?_journal=WAL&_timeout=5000&_txlock=immediate")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { sqlDB.Close() })
+	if err := db.CreateResponseTables(sqlDB, "http_response"); err != nil {
+		t.Fatal(err)
+	}
+	repo, err := db.NewRepository(sqlDB, 0, 0, "http_response")
+	if err != nil {
+		t.Fatal(err)
+	}
+	purger, err := storage.NewPurger([]*sql.DB{sqlDB})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reqConfig.Querier == nil {
+		reqConfig.Querier = repo
+	}
+	if reqConfig.Writer == nil {
+		reqConfig.Writer = repo
+	}
+	if reqConfig.CacheableStatus == nil {
+		reqConfig.CacheableStatus = config.DefaultStatusCodes()
+	}
+	if respConfig.Writer == nil {
+		respConfig.Writer = repo
+	}
+	if respConfig.Purger == nil {
+		respConfig.Purger = purger
+	}
+
+	proxy := goproxy.NewProxyHttpServer()
+	proxy.OnRequest().Do(NewRequestHandler(reqConfig))
+	proxy.OnResponse().Do(NewResponseHandler(respConfig))
+	proxy.OnResponse().Do(NewCacheStatusHandler("test"))
+	server := httptest.NewServer(proxy)
+	t.Cleanup(server.Close)
+	proxyURL, err := url.Parse(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testProxy{
+		t: t,
+		client: &http.Client{Transport: &http.Transport{
+			Proxy:              http.ProxyURL(proxyURL),
+			DisableCompression: true,
+		}},
+		repo:  repo,
+		sqlDB: sqlDB,
+	}
+}
+
+// do sends the request through the proxy and returns the response with its body
+func (p *testProxy) do(method, url string, header map[string]string, body io.Reader) (*http.Response, string) {
+	p.t.Helper()
+	req, err := http.NewRequest(method, url, body)
+	if err != nil {
+		p.t.Fatal(err)
+	}
+	for name, value := range header {
+		req.Header.Set(name, value)
+	}
+	resp, err := p.client.Do(req)
+	if err != nil {
+		p.t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		p.t.Fatal(err)
+	}
+	time.Sleep(storeDelay)
+	return resp, string(b)
+}
+
+func (p *testProxy) get(url string, header map[string]string) (*http.Response, string) {
+	p.t.Helper()
+	return p.do(http.MethodGet, url, header, nil)
+}
+
+// stored returns the number of responses stored with the URL
+func (p *testProxy) stored(url string) int {
+	p.t.Helper()
+	var n int
+	if err := p.sqlDB.QueryRow("SELECT count(*) FROM http_response WHERE url = ?", url).Scan(&n); err != nil {
+		p.t.Fatal(err)
+	}
+	return n
+}
@@ -0,0 +1,159 @@
+package proxy
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"strconv"
+	"strings"
+)
+
+// maxRanges limits the number of ranges of a request, otherwise the Range header is ignored
+const maxRanges = 100
+
+type byteRange struct {
+	start, end int64 // inclusive
+}
+
+func (br byteRange) contentRange(size int64) string {
+	return fmt.Sprintf("bytes %d-%d/%d", br.start, br.end, size)
+}
+
+// rangeResponse builds the response to a Range request from the full stored
+// body (RFC 9110 section 14): 206 (Partial Content) for satisfiable ranges,
+// multipart/byteranges for more than one range and 416 (Range Not
+// Satisfiable) otherwise. The full response is built when the Range header is
+// invalid or when the If-Range precondition fails.
+func rangeResponse(r *http.Request, status int, header http.Header, body []byte) *http.Response {
+	resp := &http.Response{
+		StatusCode: status,
+		Header:     header,
+		Body:       io.NopCloser(bytes.NewReader(body)),
+		Request:    r,
+	}
+	if ifRange := r.Header.Get("If-Range"); ifRange != "" && !ifRangeMatches(ifRange, header) {
+		return resp
+	}
+
+	size := int64(len(body))
+	ranges, ok := parseRange(r.Header.Get("Range"), size)
+	if !ok {
+		return resp
+	}
+	if len(ranges) == 0 {
+		resp := preconditionResponse(r, http.StatusRequestedRangeNotSatisfiable, header)
+		resp.Header.Set("Content-Range", fmt.Sprintf("bytes */%d", size))
+		return resp
+	}
+
+	resp.StatusCode = http.StatusPartialContent
+	resp.Status = statusLine(http.StatusPartialContent)
+	if len(ranges) == 1 {
+		part := body[ranges[0].start : ranges[0].end+1]
+		header.Set("Content-Range", ranges[0].contentRange(size))
+		header.Set("Content-Length", strconv.Itoa(len(part)))
+		resp.ContentLength = int64(len(part))
+		resp.Body = io.NopCloser(bytes.NewReader(part))
+		return resp
+	}
+
+	var buf bytes.Buffer
+	mw := multipart.NewWriter(&buf)
+	contentType := header.Get("Content-Type")
+	for _, br := range ranges {
+		partHeader := make(textproto.MIMEHeader)
+		if contentType != "" {
+			partHeader.Set("Content-Type", contentType)
+		}
+		partHeader.Set("Content-Range", br.contentRange(size))
+		pw, err := mw.CreatePart(partHeader)
+		if err != nil {
+			return resp
+		}
+		pw.Write(body[br.start : br.end+1])
+	}
+	mw.Close()
+	header.Set("Content-Type", "multipart/byteranges; boundary="+mw.Boundary())
+	header.Set("Content-Length", strconv.Itoa(buf.Len()))
+	resp.ContentLength = int64(buf.Len())
+	resp.Body = io.NopCloser(&buf)
+	return resp
+}
+
+// parseRange parses a bytes Range header. It returns false if the header is
+// invalid and must be ignored, and an empty list if no range is satisfiable.
+func parseRange(value string, size int64) ([]byteRange, bool) {
+	unit, set, found := strings.Cut(value, "=")
+	if !found || strings.TrimSpace(unit) != "bytes" {
+		return nil, false
+	}
+	specs := strings.Split(set, ",")
+	if len(specs) > maxRanges {
+		return nil, false
+	}
+	ranges := make([]byteRange, 0, len(specs))
+	valid := false
+	for _, spec := range specs {
+		spec = strings.TrimSpace(spec)
+		if spec == "" {
+			continue
+		}
+		valid = true
+		first, last, found := strings.Cut(spec, "-")
+		if !found {
+			return nil, false
+		}
+		first, last = strings.TrimSpace(first), strings.TrimSpace(last)
+		var br byteRange
+		if first == "" {
+			// suffix-range: the last N bytes
+			n, err := strconv.ParseInt(last, 10, 64)
+			if err != nil || n < 0 {
+				return nil, false
+			}
+			if n == 0 || size == 0 {
+				continue
+			}
+			br = byteRange{start: max(0, size-n), end: size - 1}
+		} else {
+			start, err := strconv.ParseInt(first, 10, 64)
+			if err != nil || start < 0 {
+				return nil, false
+			}
+			end := size - 1
+			if last != "" {
+				end, err = strconv.ParseInt(last, 10, 64)
+				if err != nil || end < start {
+					return nil, false
+				}
+			}
+			if start >= size {
+				continue
+			}
+			br = byteRange{start: start, end: min(end, size-1)}
+		}
+		ranges = append(ranges, br)
+	}
+	if !valid {
+		// a range set without any range spec is invalid (RFC 9110 section 14.1.1)
+		return nil, false
+	}
+	return ranges, true
+}
+
+// ifRangeMatches evaluates the If-Range precondition using the strong
+// comparison of entity-tags or an exact match of the Last-Modified date.
+func ifRangeMatches(value string, header http.Header) bool {
+	if strings.HasPrefix(value, `"`) || strings.HasPrefix(value, "W/") {
+		return matchETag(value, header.Get("ETag"), false)
+	}
+	t, ok := parseHTTPDate(value)
+	if !ok {
+		return false
+	}
+	lastModified, ok := parseHTTPDate(header.Get("Last-Modified"))
+	return ok && lastModified.Equal(t)
+}
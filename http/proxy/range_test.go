@@ -0,0 +1,153 @@
+package proxy
+
+import (
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseRange(t *testing.T) {
+	tests := []struct {
+		value string
+		want  []byteRange
+		ok    bool
+	}{
+		{"bytes=2-4", []byteRange{{2, 4}}, true},
+		{"bytes=5-", []byteRange{{5, 9}}, true},
+		{"bytes=-3", []byteRange{{7, 9}}, true},
+		{"bytes=-20", []byteRange{{0, 9}}, true},
+		{"bytes=8-20", []byteRange{{8, 9}}, true},
+		{"bytes=0-1, 5-6", []byteRange{{0, 1}, {5, 6}}, true},
+		{"bytes=0-1, ,5-6", []byteRange{{0, 1}, {5, 6}}, true},
+		{"bytes=10-", []byteRange{}, true},
+		{"bytes=-0", []byteRange{}, true},
+		{"bytes=", nil, false},
+		{"bytes= , ,", nil, false},
+		{"bytes=4-2", nil, false},
+		{"bytes=a-2", nil, false},
+		{"bytes=2", nil, false},
+		{"items=0-1", nil, false},
+		{"", nil, false},
+		{"bytes=" + strings.Repeat("0-1,", maxRanges) + "0-1", nil, false},
+	}
+	for _, tt := range tests {
+		got, ok := parseRange(tt.value, 10)
+		if ok != tt.ok || !slices.Equal(got, tt.want) {
+			t.Errorf("parseRange(%q) = %v, %t, want %v, %t", tt.value, got, ok, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestRangeResponse(t *testing.T) {
+	body := []byte("0123456789")
+	newHeader := func() http.Header {
+		return http.Header{
+			"Etag":         {`"v1"`},
+			"Content-Type": {"text/plain"},
+		}
+	}
+	tests := []struct {
+		name         string
+		header       map[string]string
+		status       int
+		body         string
+		contentRange string
+	}{
+		{"single", map[string]string{"Range": "bytes=2-4"}, http.StatusPartialContent, "234", "bytes 2-4/10"},
+		{"suffix", map[string]string{"Range": "bytes=-3"}, http.StatusPartialContent, "789", "bytes 7-9/10"},
+		{"unsatisfiable", map[string]string{"Range": "bytes=20-"}, http.StatusRequestedRangeNotSatisfiable, "", "bytes */10"},
+		{"invalid", map[string]string{"Range": "bytes=x"}, http.StatusOK, "0123456789", ""},
+		{"if-range match", map[string]string{"Range": "bytes=2-4", "If-Range": `"v1"`}, http.StatusPartialContent, "234", "bytes 2-4/10"},
+		{"if-range mismatch", map[string]string{"Range": "bytes=2-4", "If-Range": `"v2"`}, http.StatusOK, "0123456789", ""},
+		{"if-range weak", map[string]string{"Range": "bytes=2-4", "If-Range": `W/"v1"`}, http.StatusOK, "0123456789", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+			for name, value := range tt.header {
+				r.Header.Set(name, value)
+			}
+			resp := rangeResponse(r, http.StatusOK, newHeader(), body)
+			if resp.StatusCode != tt.status {
+				t.Fatalf("got status %d, want %d", resp.StatusCode, tt.status)
+			}
+			got, err := io.ReadAll(resp.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != tt.body {
+				t.Errorf("got body %q, want %q", got, tt.body)
+			}
+			if got := resp.Header.Get("Content-Range"); got != tt.contentRange {
+				t.Errorf("got Content-Range %q, want %q", got, tt.contentRange)
+			}
+		})
+	}
+}
+
+func TestRangeResponseMultipart(t *testing.T) {
+	r := httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+	r.Header.Set("Range", "bytes=0-1,5-")
+	resp := rangeResponse(r, http.StatusOK, http.Header{"Content-Type": {"text/plain"}}, []byte("0123456789"))
+	if resp.StatusCode != http.StatusPartialContent {
+		t.Fatalf("got status %d, want 206", resp.StatusCode)
+	}
+	mediaType, params, err := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if err != nil || mediaType != "multipart/byteranges" {
+		t.Fatalf("got Content-Type %q, want multipart/byteranges", resp.Header.Get("Content-Type"))
+	}
+	want := []struct{ body, contentRange string }{
+		{"01", "bytes 0-1/10"},
+		{"56789", "bytes 5-9/10"},
+	}
+	mr := multipart.NewReader(resp.Body, params["boundary"])
+	for i, w := range want {
+		part, err := mr.NextPart()
+		if err != nil {
+			t.Fatalf("part %d: %v", i, err)
+		}
+		got, _ := io.ReadAll(part)
+		if string(got) != w.body || part.Header.Get("Content-Range") != w.contentRange {
+			t.Errorf("part %d: got %q %q, want %q %q", i, got, part.Header.Get("Content-Range"), w.body, w.contentRange)
+		}
+		if got := part.Header.Get("Content-Type"); got != "text/plain" {
+			t.Errorf("part %d: got Content-Type %q", i, got)
+		}
+	}
+	if _, err := mr.NextPart(); err != io.EOF {
+		t.Errorf("got %v after the last part, want EOF", err)
+	}
+}
+
+func TestRangeHit(t *testing.T) {
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("ETag", `"v1"`)
+		http.ServeContent(w, r, "x.txt", time.Time{}, strings.NewReader("0123456789"))
+	}))
+	defer origin.Close()
+	p := newTestProxy(t, RequestConfig{TTL: 100}, ResponseConfig{TTL: 100})
+
+	if resp, body := p.get(origin.URL+"/x", map[string]string{"Range": "bytes=2-4"}); resp.StatusCode != http.StatusPartialContent || body != "234" {
+		t.Errorf("miss: got %d %q, want the origin 206 234", resp.StatusCode, body)
+	}
+	if n := p.stored(origin.URL + "/x"); n != 0 {
+		t.Errorf("%d partial responses stored, want 0", n)
+	}
+	p.get(origin.URL+"/x", nil)
+	resp, body := p.get(origin.URL+"/x", map[string]string{"Range": "bytes=-3"})
+	if resp.StatusCode != http.StatusPartialContent || body != "789" {
+		t.Errorf("hit: got %d %q, want 206 789", resp.StatusCode, body)
+	}
+	if got := resp.Header.Get("Content-Range"); got != "bytes 7-9/10" {
+		t.Errorf("hit: got Content-Range %q", got)
+	}
+	if got := resp.Header.Values("Cache-Status"); len(got) != 1 || !strings.Contains(got[0], "hit") {
+		t.Errorf("hit: got Cache-Status %q", got)
+	}
+}
@@ -2,6 +2,8 @@ package proxy
 
 import (
 	"context"
+	"net/http"
+	"regexp"
 	"time"
 
 	"github.com/elazarl/goproxy"
@@ -10,12 +12,25 @@ import (
 
 type RequestConfig struct {
 	Querier         RequestQuerier
+	Key             KeyFunc        // cache key of the requests, defaults to URLKey
+	Writer          ResponseWriter // used to refresh stale entries in background (stale-while-revalidate)
+	Purger          ResponsePurger // deletes the entries refreshed in background with a no-store response
 	CacheableStatus []int
 	TTL             int
 	RFC9111         bool
 	SharedCache     bool
 	ReadOnly        bool
+	StaleIfError    int // serve stale entries up to N seconds when the origin fails
+	CachePOST       []*regexp.Regexp
+	CachePOSTHeader []string // request headers included in the POST cache key
+	DisableRefresh  bool     // ignore the no-cache and max-age request directives in TTL mode
+	RewriteTTL      bool     // rewrite Cache-Control max-age and Expires to the remaining TTL in TTL mode
+	ForceCache      bool     // serve the responses stored ignoring the no-store and private directives in RFC9111 mode
+	Rules           []*Rule  // per host/path policies, the first matching rule is applied
 	Verbose         bool
+	// MaxObjectSize is the maximum body size in bytes of the responses stored
+	// by the background refreshes (0 is unlimited)
+	MaxObjectSize int64
 }
 
 type RequestQuerier interface {
@@ -23,14 +38,50 @@ type RequestQuerier interface {
 }
 
 func NewRequestHandler(config RequestConfig) goproxy.ReqHandler {
+	if config.Key == nil {
+		config.Key = URLKey
+	}
+	if len(config.Rules) > 0 {
+		handler := &requestRulesHandler{
+			rules:    config.Rules,
+			handlers: make([]goproxy.ReqHandler, len(config.Rules)),
+			key:      config.Key,
+		}
+		for i, rule := range config.Rules {
+			handler.handlers[i] = NewRequestHandler(rule.requestConfig(config))
+		}
+		config.Rules = nil
+		handler.fallback = NewRequestHandler(config)
+		return handler
+	}
 	if config.RFC9111 {
-		return &requestRFC9111Handler{
+		handler := &requestRFC9111Handler{
 			shared:          config.SharedCache,
 			cacheableStatus: config.CacheableStatus,
+			ttlFallback:     config.TTL,
 			verbose:         config.Verbose,
 			readOnly:        config.ReadOnly,
 			querier:         config.Querier,
+			key:             config.Key,
+			staleIfError:    config.StaleIfError,
+			cachePOST:       config.CachePOST,
+			cachePOSTHeader: config.CachePOSTHeader,
+			forceCache:      config.ForceCache,
 		}
+		if !config.ReadOnly && config.Writer != nil {
+			handler.revalidator = &responseRFC9111Handler{
+				shared:      config.SharedCache,
+				ttlFallback: config.TTL,
+				writer:      config.Writer,
+				purger:      config.Purger,
+				key:         config.Key,
+				cachePOST:   config.CachePOST,
+				maxSize:     config.MaxObjectSize,
+				forceCache:  config.ForceCache,
+				verbose:     config.Verbose,
+			}
+		}
+		return handler
 	}
 	return &requestTTLHandler{
 		verbose:         config.Verbose,
@@ -38,11 +89,50 @@ func NewRequestHandler(config RequestConfig) goproxy.ReqHandler {
 		ttl:             config.TTL,
 		readOnly:        config.ReadOnly,
 		querier:         config.Querier,
+		key:             config.Key,
+		staleIfError:    config.StaleIfError,
+		cachePOST:       config.CachePOST,
+		cachePOSTHeader: config.CachePOSTHeader,
+		disableRefresh:  config.DisableRefresh,
+		rewrite:         config.RewriteTTL,
 	}
 }
 
 type userData struct {
+	key         string
 	requestTime time.Time
 	databaseID  int
 	tableName   string
+
+	// location of the secondary (Vary) entry
+	variantDatabaseID int
+	variantTableName  string
+	reqHeader         http.Header
+
+	// expired entry, served when revalidated by a conditional
+	// request or when the origin fails (stale-if-error)
+	stale        *storedResponse
+	revalidate   bool
+	staleIfError bool
+
+	status *cacheStatus
+}
+
+func newUserData(requestTime time.Time, key string, primary *db.Response, variant *db.Response, reqHeader http.Header) userData {
+	ud := userData{
+		key:               key,
+		requestTime:       requestTime,
+		databaseID:        -1,
+		variantDatabaseID: -1,
+		reqHeader:         reqHeader.Clone(),
+	}
+	if primary != nil {
+		ud.databaseID = primary.DatabaseID
+		ud.tableName = primary.TableName
+	}
+	if variant != nil && variant != primary {
+		ud.variantDatabaseID = variant.DatabaseID
+		ud.variantTableName = variant.TableName
+	}
+	return ud
 }
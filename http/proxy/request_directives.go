@@ -0,0 +1,151 @@
+package proxy
+
+import (
+	"io"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// parseDirectives returns the Cache-Control directives of the header.
+// Directive names are lowercased and directives without value are mapped to "".
+func parseDirectives(header http.Header) map[string]string {
+	directives := make(map[string]string)
+	for _, value := range header.Values("Cache-Control") {
+		for _, d := range strings.Split(value, ",") {
+			name, arg, _ := strings.Cut(strings.TrimSpace(d), "=")
+			name = strings.ToLower(strings.TrimSpace(name))
+			if name == "" {
+				continue
+			}
+			directives[name] = strings.Trim(strings.TrimSpace(arg), `"`)
+		}
+	}
+	return directives
+}
+
+// withoutNoStore returns a copy of the header without the no-store and
+// private response directives, to store and serve the responses of the
+// force-cache rules with the freshness given by the other directives.
+func withoutNoStore(header http.Header) http.Header {
+	values := header.Values("Cache-Control")
+	if len(values) == 0 {
+		return header
+	}
+	kept := make([]string, 0)
+	for _, value := range values {
+		for _, d := range strings.Split(value, ",") {
+			name, _, _ := strings.Cut(strings.TrimSpace(d), "=")
+			switch strings.ToLower(strings.TrimSpace(name)) {
+			case "", "no-store", "private":
+				continue
+			}
+			kept = append(kept, strings.TrimSpace(d))
+		}
+	}
+	header = header.Clone()
+	header.Del("Cache-Control")
+	if len(kept) > 0 {
+		header.Set("Cache-Control", strings.Join(kept, ", "))
+	}
+	return header
+}
+
+func directiveSeconds(directives map[string]string, name string) (int, bool) {
+	arg, ok := directives[name]
+	if !ok {
+		return 0, false
+	}
+	seconds, err := strconv.Atoi(arg)
+	if err != nil || seconds < 0 {
+		return 0, false
+	}
+	return seconds, true
+}
+
+// requestDirectives are the request Cache-Control directives used to select
+// a stored response (RFC 9111 section 5.2.1)
+type requestDirectives struct {
+	noCache      bool
+	noStore      bool
+	onlyIfCached bool
+	maxAge       *int
+	maxStale     *int // math.MaxInt when any staleness is accepted
+	minFresh     *int
+}
+
+func parseRequestDirectives(header http.Header) requestDirectives {
+	directives := parseDirectives(header)
+	var rd requestDirectives
+	_, rd.noCache = directives["no-cache"]
+	if len(header.Values("Cache-Control")) == 0 && pragmaNoCache(header) {
+		// HTTP/1.0 clients (RFC 9111 section 5.4)
+		rd.noCache = true
+	}
+	_, rd.noStore = directives["no-store"]
+	_, rd.onlyIfCached = directives["only-if-cached"]
+	if v, ok := directiveSeconds(directives, "max-age"); ok {
+		rd.maxAge = &v
+	}
+	if v, ok := directiveSeconds(directives, "min-fresh"); ok {
+		rd.minFresh = &v
+	}
+	if arg, ok := directives["max-stale"]; ok {
+		v := math.MaxInt
+		if arg != "" {
+			v, ok = directiveSeconds(directives, "max-stale")
+		}
+		if ok {
+			rd.maxStale = &v
+		}
+	}
+	return rd
+}
+
+func pragmaNoCache(header http.Header) bool {
+	for _, value := range header.Values("Pragma") {
+		for _, d := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(d), "no-cache") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// requireFresh reports whether the client demands a fresher response than
+// the origin freshness rules, making stale-while-revalidate not applicable.
+func (rd requestDirectives) requireFresh() bool {
+	return rd.noCache || rd.maxAge != nil || rd.minFresh != nil
+}
+
+// stale reports whether the stored response cannot be served without
+// contacting the origin, given its age, its freshness lifetime and whether
+// it is expired according to the origin freshness rules.
+func (rd requestDirectives) stale(expired bool, age int, lifetime int) bool {
+	switch {
+	case rd.noCache:
+		return true
+	case rd.maxAge != nil && (age > *rd.maxAge || *rd.maxAge == 0):
+		// max-age=0 asks for a response validated by the origin
+		return true
+	case rd.minFresh != nil && lifetime-age < *rd.minFresh:
+		return true
+	case expired:
+		return rd.maxStale == nil || age-lifetime > *rd.maxStale
+	default:
+		return false
+	}
+}
+
+// gatewayTimeout is the response to only-if-cached requests that cannot be satisfied by the cache
+func gatewayTimeout(r *http.Request) *http.Response {
+	return &http.Response{
+		StatusCode: http.StatusGatewayTimeout,
+		Status:     statusLine(http.StatusGatewayTimeout),
+		Header:     make(http.Header),
+		Body:       io.NopCloser(strings.NewReader("")),
+		Request:    r,
+	}
+}
@@ -3,10 +3,11 @@ package proxy
 import (
 	"database/sql"
 	"errors"
-	"fmt"
 	"log/slog"
 	"net/http"
+	"regexp"
 	"slices"
+	"sync"
 	"time"
 
 	"github.com/elazarl/goproxy"
@@ -20,15 +21,38 @@ type requestRFC9111Handler struct {
 	verbose         bool
 	readOnly        bool
 	querier         RequestQuerier
+	key             KeyFunc
+	staleIfError    int
+	cachePOST       []*regexp.Regexp
+	cachePOSTHeader []string
+	forceCache      bool
+
+	// refresh stale-while-revalidate entries in background
+	revalidator  *responseRFC9111Handler
+	revalidating sync.Map
 }
 
 func (h *requestRFC9111Handler) Handle(r *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
-	if r.Method != http.MethodGet {
+	url := h.key(ctx.Req)
+	status := newCacheStatus(url)
+	ctx.UserData = status
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+	case http.MethodPost:
+		key, ok := postKey(r, url, h.cachePOST, h.cachePOSTHeader)
+		if !ok {
+			status.fwd = fwdMethod
+			return r, nil
+		}
+		url = key
+		status.key = key
+	default:
+		status.fwd = fwdMethod
 		return r, nil
 	}
 
-	cc := cachehttp.ParseCacheControl(r.Header, nil, nil, h.shared, h.ttlFallback)
-	if !cc.Cacheable() {
+	reqCC := parseRequestDirectives(r.Header)
+	if reqCC.noStore {
 		return r, nil
 	}
 	if h.shared && r.Header.Get("Authorization") != "" {
@@ -36,37 +60,96 @@ func (h *requestRFC9111Handler) Handle(r *http.Request, ctx *goproxy.ProxyCtx) (
 	}
 
 	now := time.Now()
-	url := ctx.Req.URL.String()
-	resp, err := h.querier.FindByURL(r.Context(), url)
+	primary, resp, err := lookup(r.Context(), h.querier, url, r.Header)
 	if err != nil {
 		if !errors.Is(err, sql.ErrNoRows) {
 			slog.Error("database query", "error", err.Error())
 		}
+		status.fwd = fwdURIMiss
+		if primary != nil {
+			status.fwd = fwdVaryMiss
+		}
+		if reqCC.onlyIfCached {
+			return r, gatewayTimeout(r)
+		}
 
-		if !h.readOnly {
+		if !h.readOnly && r.Method != http.MethodHead {
 			// tell the responseHandler to save the new response data
-			ctx.UserData = userData{
-				requestTime: now,
-				databaseID:  -1,
-			}
+			ud := newUserData(now, url, primary, nil, r.Header)
+			ud.status = status
+			ctx.UserData = ud
 		}
 		return r, nil
 	}
 
 	if !slices.Contains(h.cacheableStatus, resp.Status) {
+		status.fwd = fwdMiss
 		return r, nil
 	}
 
-	respCC := cachehttp.ParseCacheControl(http.Header(resp.Header), &resp.RequestTime, &resp.ResponseTime, h.shared, h.ttlFallback)
+	header := http.Header(resp.Header)
+	ccHeader := header
+	if h.forceCache {
+		ccHeader = withoutNoStore(header)
+	}
+	respCC := cachehttp.ParseCacheControl(ccHeader, &resp.RequestTime, &resp.ResponseTime, h.shared, h.ttlFallback)
+	expired := respCC.Expired()
+	age := currentAge(header, resp.RequestTime, resp.ResponseTime)
+	lifetime := respCC.FreshnessLifetime()
+
+	// must-revalidate entries (and proxy-revalidate or s-maxage ones in a
+	// shared cache) are never served stale (RFC 9111 section 5.2.2.2)
+	mustRevalidate := respCC.MustRevalidate() ||
+		(h.shared && (respCC.ProxyRevalidate() || respCC.SMaxAge() != nil))
 
-	if respCC.Expired() {
+	ttl := lifetime - age
+	if reqCC.stale(expired, age, lifetime) || (expired && mustRevalidate) {
+		status.fwd = fwdStale
+		if !expired {
+			status.fwd = fwdRequest
+		}
+		if reqCC.onlyIfCached {
+			resp.Body.Close()
+			return r, gatewayTimeout(r)
+		}
+		stale, err := newStoredResponse(resp)
+		if err != nil {
+			slog.Error("reading stale response", "error", err, "url", url)
+			return r, nil
+		}
+		staleFor := age - lifetime
+		ud := newUserData(now, url, primary, resp, r.Header)
+		ud.stale = stale
+		ud.status = status
+		if swr, ok := directiveSeconds(parseDirectives(stale.header), "stale-while-revalidate"); ok && h.revalidator != nil &&
+			expired && !mustRevalidate && !reqCC.requireFresh() && staleFor <= swr {
+			key := url
+			if fields := varyFields(stale.header); len(fields) > 0 {
+				key = varyKey(url, fields, r.Header)
+			}
+			h.revalidateInBackground(r, ctx, key, ud)
+			status.served(resp, &ttl)
+			if h.verbose {
+				slog.Info("serving stale from database while revalidating", "url", url, "status", stale.status)
+			}
+			return r, serveStale(r, stale, warningStale)
+		}
 		if !h.readOnly {
-			// data is too old, tell the responseHandler to save the new data
-			ctx.UserData = userData{
-				requestTime: now,
-				databaseID:  resp.DatabaseID,
-				tableName:   resp.TableName,
+			// data is too old, tell the responseHandler to save the new data.
+			// The stale entry is served if the origin replies 304 Not Modified
+			if r.Method == http.MethodGet {
+				ud.revalidate = addValidators(r, stale.header)
+			}
+			if !mustRevalidate && staleIfErrorAllowed(h.staleIfError, staleFor, stale.header, r.Header) {
+				ud.staleIfError = true
+				handleOriginErrors(ctx, originErrorStatus)
 			}
+			ctx.UserData = ud
+		} else if !mustRevalidate && staleIfErrorAllowed(h.staleIfError, staleFor, stale.header, r.Header) {
+			serveStaleOnOriginError(ctx, url, stale, status)
+		}
+		if mustRevalidate {
+			handleOriginErrors(ctx, revalidationFailedStatus)
 		}
 		return r, nil
 	}
@@ -74,17 +157,11 @@ func (h *requestRFC9111Handler) Handle(r *http.Request, ctx *goproxy.ProxyCtx) (
 		slog.Info("serving from database", "url", url, "status", resp.Status, "request_time", resp.RequestTime.Format(time.RFC3339), "response_time", resp.ResponseTime.Format(time.RFC3339))
 	}
 
-	header := http.Header(resp.Header)
-	if header.Get("Date") == "" {
-		header.Set("Date", time.Now().Format(time.RFC1123))
-	}
-	if age := cachehttp.Age(header, resp.RequestTime, resp.ResponseTime); age != nil {
-		header.Set("Age", fmt.Sprint(*age))
-	}
-
-	return r, &http.Response{
-		StatusCode: resp.Status,
-		Body:       resp.Body,
-		Header:     header,
+	status.served(resp, &ttl)
+	served := serveStored(r, resp)
+	if expired {
+		// stale response allowed by the max-stale request directive
+		served.Header.Add("Warning", warningStale)
 	}
+	return r, served
 }
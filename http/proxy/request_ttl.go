@@ -3,14 +3,14 @@ package proxy
 import (
 	"database/sql"
 	"errors"
-	"fmt"
 	"log/slog"
+	"math"
 	"net/http"
+	"regexp"
 	"slices"
 	"time"
 
 	"github.com/elazarl/goproxy"
-	cachehttp "github.com/litesql/httpcache/http"
 )
 
 type requestTTLHandler struct {
@@ -19,55 +19,112 @@ type requestTTLHandler struct {
 	ttl             int
 	readOnly        bool
 	querier         RequestQuerier
+	key             KeyFunc
+	staleIfError    int
+	cachePOST       []*regexp.Regexp
+	cachePOSTHeader []string
+	disableRefresh  bool
+	rewrite         bool
 }
 
 func (h *requestTTLHandler) Handle(r *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
-	if r.Method != http.MethodGet {
+	url := h.key(ctx.Req)
+	status := newCacheStatus(url)
+	ctx.UserData = status
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+	case http.MethodPost:
+		key, ok := postKey(r, url, h.cachePOST, h.cachePOSTHeader)
+		if !ok {
+			status.fwd = fwdMethod
+			return r, nil
+		}
+		url = key
+		status.key = key
+	default:
+		status.fwd = fwdMethod
 		return r, nil
 	}
 
-	url := ctx.Req.URL.String()
+	reqCC := parseRequestDirectives(r.Header)
+	if h.disableRefresh {
+		// clients are not allowed to bypass the stored responses
+		reqCC.noCache = false
+		reqCC.maxAge = nil
+	}
 	resp, err := h.querier.FindByURL(r.Context(), url)
 	if err != nil {
 		if !errors.Is(err, sql.ErrNoRows) {
 			slog.Error("database query", "error", err.Error())
 		}
-		// tell the responseHandler to save the new response data
-		ctx.UserData = userData{
-			requestTime: time.Now(),
-			databaseID:  -1,
+		status.fwd = fwdURIMiss
+		if reqCC.onlyIfCached {
+			return r, gatewayTimeout(r)
+		}
+		if r.Method != http.MethodHead {
+			// tell the responseHandler to save the new response data
+			ud := newUserData(time.Now(), url, nil, nil, r.Header)
+			ud.status = status
+			ctx.UserData = ud
 		}
 		return r, nil
 	}
 	if !slices.Contains(h.cacheableStatus, resp.Status) {
+		status.fwd = fwdMiss
 		return r, nil
 	}
 
-	if !h.readOnly && h.ttl > 0 && int(time.Since(resp.ResponseTime).Seconds()) > h.ttl {
+	age := int(time.Since(resp.ResponseTime).Seconds())
+	lifetime := h.ttl
+	if lifetime <= 0 {
+		lifetime = math.MaxInt
+	}
+	expired := !h.readOnly && h.ttl > 0 && age > h.ttl
+	if reqCC.stale(expired, age, lifetime) {
+		status.fwd = fwdStale
+		if !expired {
+			status.fwd = fwdRequest
+		}
+		if reqCC.onlyIfCached {
+			resp.Body.Close()
+			return r, gatewayTimeout(r)
+		}
 		// data is too old, tell the responseHandler to save the new data
-		ctx.UserData = userData{
-			requestTime: time.Now(),
-			databaseID:  resp.DatabaseID,
-			tableName:   resp.TableName,
+		ud := newUserData(time.Now(), url, resp, nil, r.Header)
+		ud.status = status
+		staleIfError := staleIfErrorAllowed(h.staleIfError, age-lifetime)
+		if staleIfError || r.Method == http.MethodHead {
+			stale, err := newStoredResponse(resp)
+			if err != nil {
+				slog.Error("reading stale response", "error", err, "url", url)
+			} else {
+				ud.stale = stale
+				if staleIfError {
+					ud.staleIfError = true
+					handleOriginErrors(ctx, originErrorStatus)
+				}
+			}
 		}
+		ctx.UserData = ud
 		return r, nil
 	}
 	if h.verbose {
 		slog.Info("serving from database", "url", url, "status", resp.Status, "request_time", resp.RequestTime.Format(time.RFC3339), "response_time", resp.ResponseTime.Format(time.RFC3339))
 	}
 
-	header := http.Header(resp.Header)
-	if header.Get("Date") == "" {
-		header.Set("Date", time.Now().Format(time.RFC1123))
+	var ttl *int
+	if h.ttl > 0 {
+		remaining := h.ttl - age
+		ttl = &remaining
 	}
-
-	if age := cachehttp.Age(header, resp.RequestTime, resp.ResponseTime); age != nil {
-		header.Set("Age", fmt.Sprint(*age))
+	status.served(resp, ttl)
+	served := serveStored(r, resp)
+	if h.rewrite && h.ttl > 0 {
+		rewriteFreshness(served.Header, h.ttl-age)
 	}
-
-	return r, &http.Response{
-		StatusCode: resp.Status,
-		Body:       resp.Body,
-		Header:     header,
+	if expired {
+		// stale response allowed by the max-stale request directive
+		served.Header.Add("Warning", warningStale)
 	}
+	return r, served
 }
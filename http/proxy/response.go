@@ -2,34 +2,79 @@ package proxy
 
 import (
 	"context"
+	"regexp"
 
 	"github.com/elazarl/goproxy"
 	"github.com/litesql/httpcache/db"
 )
 
 type ResponseConfig struct {
+	// Writer is called by the proxy goroutines, wrap it with a
+	// storage.WriteQueue to store the responses in background
 	Writer      ResponseWriter
+	Purger      ResponsePurger
+	Key         KeyFunc // cache key of the requests, defaults to URLKey
 	RFC9111     bool
 	TTL         int
 	Verbose     bool
 	SharedCache bool
+	HeadUpdate  bool // update stored responses with the headers of HEAD responses
+	CachePOST   []*regexp.Regexp
+	RewriteTTL  bool    // rewrite Cache-Control max-age and Expires to the TTL in TTL mode
+	ForceCache  bool    // store the responses ignoring the no-store and private directives in RFC9111 mode
+	Rules       []*Rule // per host/path policies, the first matching rule is applied
+	// MaxObjectSize is the maximum body size in bytes of the stored responses (0 is unlimited)
+	MaxObjectSize int64
 }
 
+// ResponseWriter stores responses. The writer closes the response body.
 type ResponseWriter interface {
 	Write(ctx context.Context, url string, resp *db.Response) error
 }
 
+type ResponsePurger interface {
+	Purge(ctx context.Context, url string) error
+}
+
 func NewResponseHandler(config ResponseConfig) goproxy.RespHandler {
+	if config.Key == nil {
+		config.Key = URLKey
+	}
+	if len(config.Rules) > 0 {
+		handler := &responseRulesHandler{
+			rules:    config.Rules,
+			handlers: make([]goproxy.RespHandler, len(config.Rules)),
+		}
+		for i, rule := range config.Rules {
+			handler.handlers[i] = NewResponseHandler(rule.responseConfig(config))
+		}
+		config.Rules = nil
+		handler.fallback = NewResponseHandler(config)
+		return handler
+	}
 	if config.RFC9111 {
 		return &responseRFC9111Handler{
 			shared:      config.SharedCache,
 			ttlFallback: config.TTL,
 			writer:      config.Writer,
+			purger:      config.Purger,
+			key:         config.Key,
+			cachePOST:   config.CachePOST,
+			maxSize:     config.MaxObjectSize,
+			forceCache:  config.ForceCache,
 			verbose:     config.Verbose,
+			headUpdate:  config.HeadUpdate,
 		}
 	}
 	return &responseTTLHandler{
-		writer:  config.Writer,
-		verbose: config.Verbose,
+		ttl:        config.TTL,
+		rewrite:    config.RewriteTTL,
+		writer:     config.Writer,
+		purger:     config.Purger,
+		key:        config.Key,
+		cachePOST:  config.CachePOST,
+		maxSize:    config.MaxObjectSize,
+		verbose:    config.Verbose,
+		headUpdate: config.HeadUpdate,
 	}
 }
@@ -1,9 +1,13 @@
 package proxy
 
 import (
+	"bytes"
 	"context"
+	"io"
 	"log/slog"
 	"net/http"
+	"regexp"
+	"strings"
 	"time"
 
 	"github.com/elazarl/goproxy"
@@ -15,43 +19,156 @@ type responseRFC9111Handler struct {
 	shared      bool
 	ttlFallback int
 	writer      ResponseWriter
+	purger      ResponsePurger
+	key         KeyFunc
+	cachePOST   []*regexp.Regexp
+	maxSize     int64
+	forceCache  bool
 	verbose     bool
+	headUpdate  bool
 }
 
 func (h *responseRFC9111Handler) Handle(resp *http.Response, ctx *goproxy.ProxyCtx) *http.Response {
+	if resp == nil {
+		return resp
+	}
+	if !isSafe(ctx.Req.Method) && !cacheablePOST(ctx.Req, h.cachePOST) {
+		invalidate(h.purger, h.key, ctx.Req, resp, h.verbose)
+		return resp
+	}
+	url := h.key(ctx.Req)
 	requestTime := time.Now()
 	ud, ok := ctx.UserData.(userData)
 	if ok {
+		url = ud.key
 		requestTime = ud.requestTime
 	}
 
-	responseTime := time.Now()
-	cc := cachehttp.ParseCacheControl(resp.Header, &requestTime, &responseTime, h.shared, h.ttlFallback)
-	if !cc.Cacheable() || !ok {
+	if ok && ud.staleIfError && resp.StatusCode >= http.StatusInternalServerError {
+		slog.Warn("serving stale response on origin error", "url", url, "status", resp.StatusCode)
+		ud.status.forwarded(resp.StatusCode)
+		return serveStale(ctx.Req, ud.stale, warningRevalidationFailed)
+	}
+	if ctx.Req.Method == http.MethodHead {
+		if ok && h.headUpdate && ud.stale != nil && headMatches(ud.stale, resp) {
+			ud.stale.header = mergeHeaders(ud.stale.header, resp.Header)
+			if h.verbose {
+				slog.Info("updating response from HEAD", "url", url, "status", ud.stale.status)
+			}
+			h.store(url, ud, ud.stale.toDB(ud.requestTime, time.Now()))
+		}
 		return resp
 	}
+	if ok && ud.revalidate && resp.StatusCode == http.StatusNotModified {
+		return h.revalidated(resp, url, ud)
+	}
 
-	responseDB, err := db.HttpToResponse(resp)
-	if err != nil {
-		slog.Error("adapter response body", "error", err)
-	} else {
-		if !cc.Expired() {
-			return resp
+	responseTime := time.Now()
+	ccHeader := resp.Header
+	if h.forceCache {
+		ccHeader = withoutNoStore(ccHeader)
+	}
+	cc := cachehttp.ParseCacheControl(ccHeader, &requestTime, &responseTime, h.shared, h.ttlFallback)
+	if ok && cc.NoStore() && ud.databaseID >= 0 {
+		// the origin no longer allows storing the response, drop the stored entry
+		if h.verbose {
+			slog.Info("deleting stored response", "url", url, "status", resp.StatusCode)
 		}
+		purge(h.purger, url)
+	}
+	if !cc.Cacheable() || !ok || cc.Expired() ||
+		resp.StatusCode == http.StatusNotModified || resp.StatusCode == http.StatusPartialContent {
+		return resp
+	}
+
+	if h.maxSize > 0 && resp.ContentLength > h.maxSize {
 		if h.verbose {
-			slog.Info("recording response", "url", ctx.Req.URL.String(), "status", resp.StatusCode)
+			slog.Info("response too large to be stored", "url", url, "status", resp.StatusCode)
 		}
-		go func() {
-			responseDB.RequestTime = ud.requestTime
-			responseDB.ResponseTime = time.Now()
-			responseDB.DatabaseID = ud.databaseID
-			responseDB.TableName = ud.tableName
-			err := h.writer.Write(context.Background(), ctx.Req.URL.String(), responseDB)
-			if err != nil {
-				slog.Error("recording response", "error", err, "url", ctx.Req.URL.String(), "status", resp.StatusCode)
-			}
-		}()
+		return resp
+	}
+	fields := varyFields(resp.Header)
+	if len(fields) > 0 && fields[0] == "*" {
+		// a Vary of "*" never matches a subsequent request
+		return resp
+	}
+
+	if h.verbose {
+		slog.Info("recording response", "url", url, "status", resp.StatusCode)
+	}
+	ud.status.markStored()
+	responseDB := &db.Response{
+		Status:       resp.StatusCode,
+		Header:       resp.Header,
+		RequestTime:  requestTime,
+		ResponseTime: responseTime,
+	}
+	spool(resp, url, h.maxSize, h.verbose, func(body io.ReadCloser) {
+		responseDB.Body = body
+		h.save(url, ud, fields, responseDB)
+	})
+	return resp
+}
+
+// revalidated serves the stale entry updated with the headers of the 304 (Not Modified) response.
+func (h *responseRFC9111Handler) revalidated(resp *http.Response, url string, ud userData) *http.Response {
+	stale := ud.stale
+	stale.header = mergeHeaders(stale.header, resp.Header)
+	if h.verbose {
+		slog.Info("revalidated response", "url", url, "status", stale.status)
 	}
+	h.store(url, ud, stale.toDB(ud.requestTime, time.Now()))
 
+	ud.status.forwarded(resp.StatusCode)
+	resp.StatusCode = stale.status
+	resp.Status = statusLine(stale.status)
+	resp.Header = stale.header.Clone()
+	if stale.compressed {
+		varyEncoding(resp.Header)
+	}
+	resp.ContentLength = int64(len(stale.body))
+	resp.Body = io.NopCloser(bytes.NewReader(stale.body))
 	return resp
 }
+
+// store writes the response
+func (h *responseRFC9111Handler) store(url string, ud userData, responseDB *db.Response) {
+	fields := varyFields(http.Header(responseDB.Header))
+	if len(fields) > 0 && fields[0] == "*" {
+		// a Vary of "*" never matches a subsequent request
+		return
+	}
+	ud.status.markStored()
+	h.save(url, ud, fields, responseDB)
+}
+
+// save writes the response. Responses with a Vary header are stored using
+// the secondary key and the primary entry keeps only the headers.
+func (h *responseRFC9111Handler) save(url string, ud userData, fields []string, responseDB *db.Response) {
+	if len(fields) == 0 {
+		responseDB.DatabaseID = ud.databaseID
+		responseDB.TableName = ud.tableName
+		h.write(url, responseDB)
+		return
+	}
+
+	h.write(url, &db.Response{
+		Status:       responseDB.Status,
+		Header:       responseDB.Header,
+		Body:         io.NopCloser(strings.NewReader("")),
+		RequestTime:  responseDB.RequestTime,
+		ResponseTime: responseDB.ResponseTime,
+		DatabaseID:   ud.databaseID,
+		TableName:    ud.tableName,
+	})
+	responseDB.DatabaseID = ud.variantDatabaseID
+	responseDB.TableName = ud.variantTableName
+	h.write(varyKey(url, fields, ud.reqHeader), responseDB)
+}
+
+func (h *responseRFC9111Handler) write(url string, resp *db.Response) {
+	err := h.writer.Write(context.Background(), url, resp)
+	if err != nil {
+		slog.Error("recording response", "error", err, "url", url, "status", resp.Status)
+	}
+}
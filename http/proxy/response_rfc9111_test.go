@@ -0,0 +1,131 @@
+package proxy
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestAddValidators(t *testing.T) {
+	stored := http.Header{
+		"Etag":          {`"v1"`},
+		"Last-Modified": {"Mon, 02 Jan 2006 15:04:05 GMT"},
+	}
+	r := httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+	if !addValidators(r, stored) {
+		t.Fatal("request not made conditional")
+	}
+	if got := r.Header.Get("If-None-Match"); got != `"v1"` {
+		t.Errorf("got If-None-Match %q, want %q", got, `"v1"`)
+	}
+	if got := r.Header.Get("If-Modified-Since"); got != "Mon, 02 Jan 2006 15:04:05 GMT" {
+		t.Errorf("got If-Modified-Since %q", got)
+	}
+
+	r = httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+	r.Header.Set("If-None-Match", `"client"`)
+	if addValidators(r, stored) {
+		t.Error("client preconditions replaced")
+	}
+	if got := r.Header.Get("If-None-Match"); got != `"client"` {
+		t.Errorf("got If-None-Match %q, want the client one", got)
+	}
+
+	r = httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+	if addValidators(r, http.Header{}) {
+		t.Error("request made conditional without validators")
+	}
+}
+
+func TestMergeHeaders(t *testing.T) {
+	stored := http.Header{
+		"Content-Type":   {"text/plain"},
+		"Content-Length": {"5"},
+		"X-Version":      {"1"},
+	}
+	fresh := http.Header{
+		"Content-Length": {"0"},
+		"Connection":     {"close"},
+		"X-Version":      {"2"},
+	}
+	merged := mergeHeaders(stored, fresh)
+	if got := merged.Get("X-Version"); got != "2" {
+		t.Errorf("got X-Version %q, want 2", got)
+	}
+	if got := merged.Get("Content-Length"); got != "5" {
+		t.Errorf("got Content-Length %q, want the stored 5", got)
+	}
+	if got := merged.Get("Connection"); got != "" {
+		t.Errorf("hop-by-hop Connection %q merged", got)
+	}
+	if got := stored.Get("X-Version"); got != "1" {
+		t.Errorf("stored headers changed: X-Version %q", got)
+	}
+}
+
+func TestRevalidateNotModified(t *testing.T) {
+	t.Parallel()
+	var hits atomic.Int32
+	var ifNoneMatch atomic.Value
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := hits.Add(1)
+		ifNoneMatch.Store(r.Header.Get("If-None-Match"))
+		w.Header().Set("Cache-Control", "max-age=1")
+		w.Header().Set("ETag", `"v1"`)
+		w.Header().Set("X-Hit", fmt.Sprint(n))
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		fmt.Fprint(w, "hello")
+	}))
+	defer origin.Close()
+	p := newTestProxy(t, RequestConfig{RFC9111: true}, ResponseConfig{RFC9111: true})
+
+	p.get(origin.URL+"/x", nil)
+	time.Sleep(2100 * time.Millisecond)
+
+	resp, body := p.get(origin.URL+"/x", nil)
+	if resp.StatusCode != http.StatusOK || body != "hello" {
+		t.Fatalf("got %d %q, want the stored 200 hello", resp.StatusCode, body)
+	}
+	if got := ifNoneMatch.Load(); got != `"v1"` {
+		t.Errorf("origin got If-None-Match %q, want %q", got, `"v1"`)
+	}
+	if got := resp.Header.Get("X-Hit"); got != "2" {
+		t.Errorf("got X-Hit %q, want the 304 header 2", got)
+	}
+
+	resp, body = p.get(origin.URL+"/x", nil)
+	if body != "hello" || resp.Header.Get("X-Hit") != "2" {
+		t.Errorf("got %q with X-Hit %q, want the updated stored response", body, resp.Header.Get("X-Hit"))
+	}
+	if n := hits.Load(); n != 2 {
+		t.Errorf("origin got %d requests, want 2", n)
+	}
+}
+
+func TestRevalidateModified(t *testing.T) {
+	t.Parallel()
+	var hits atomic.Int32
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := hits.Add(1)
+		w.Header().Set("Cache-Control", "max-age=1")
+		w.Header().Set("Last-Modified", time.Now().UTC().Format(http.TimeFormat))
+		fmt.Fprintf(w, "v%d", n)
+	}))
+	defer origin.Close()
+	p := newTestProxy(t, RequestConfig{RFC9111: true}, ResponseConfig{RFC9111: true})
+
+	p.get(origin.URL+"/x", nil)
+	time.Sleep(2100 * time.Millisecond)
+	if _, body := p.get(origin.URL+"/x", nil); body != "v2" {
+		t.Errorf("got %q, want the modified v2", body)
+	}
+	if _, body := p.get(origin.URL+"/x", nil); body != "v2" {
+		t.Errorf("got %q, want the stored v2", body)
+	}
+}
@@ -2,8 +2,10 @@ package proxy
 
 import (
 	"context"
+	"io"
 	"log/slog"
 	"net/http"
+	"regexp"
 	"time"
 
 	"github.com/elazarl/goproxy"
@@ -11,31 +13,85 @@ import (
 )
 
 type responseTTLHandler struct {
-	writer  ResponseWriter
-	verbose bool
+	ttl        int
+	rewrite    bool
+	writer     ResponseWriter
+	purger     ResponsePurger
+	key        KeyFunc
+	cachePOST  []*regexp.Regexp
+	maxSize    int64
+	verbose    bool
+	headUpdate bool
 }
 
 func (h *responseTTLHandler) Handle(resp *http.Response, ctx *goproxy.ProxyCtx) *http.Response {
+	if resp == nil {
+		return resp
+	}
+	if !isSafe(ctx.Req.Method) && !cacheablePOST(ctx.Req, h.cachePOST) {
+		invalidate(h.purger, h.key, ctx.Req, resp, h.verbose)
+		return resp
+	}
 	ud, ok := ctx.UserData.(userData)
+	if ok && ud.staleIfError && resp.StatusCode >= http.StatusInternalServerError {
+		slog.Warn("serving stale response on origin error", "url", ctx.Req.URL.String(), "status", resp.StatusCode)
+		ud.status.forwarded(resp.StatusCode)
+		return serveStale(ctx.Req, ud.stale, warningRevalidationFailed)
+	}
+	url := h.key(ctx.Req)
 	if ok {
+		url = ud.key
+	}
+	if ctx.Req.Method == http.MethodHead {
+		if ok && h.headUpdate && ud.stale != nil && headMatches(ud.stale, resp) {
+			stale := ud.stale
+			stale.header = mergeHeaders(stale.header, resp.Header)
+			if h.verbose {
+				slog.Info("updating response from HEAD", "url", url, "status", stale.status)
+			}
+			responseDB := stale.toDB(ud.requestTime, time.Now())
+			responseDB.DatabaseID = ud.databaseID
+			responseDB.TableName = ud.tableName
+			ud.status.markStored()
+			h.write(url, responseDB)
+		}
+		return resp
+	}
+	if ok && resp.StatusCode != http.StatusNotModified && resp.StatusCode != http.StatusPartialContent {
+		if h.maxSize > 0 && resp.ContentLength > h.maxSize {
+			if h.verbose {
+				slog.Info("response too large to be stored", "url", url, "status", resp.StatusCode)
+			}
+			return resp
+		}
 		if h.verbose {
-			slog.Info("recording response", "url", ctx.Req.URL.String(), "status", resp.StatusCode)
+			slog.Info("recording response", "url", url, "status", resp.StatusCode)
+		}
+		responseDB := &db.Response{
+			Status:       resp.StatusCode,
+			Header:       resp.Header,
+			RequestTime:  ud.requestTime,
+			ResponseTime: time.Now(),
+			DatabaseID:   ud.databaseID,
+			TableName:    ud.tableName,
 		}
-		responseDB, err := db.HttpToResponse(resp)
-		if err != nil {
-			slog.Error("adapter response body", "error", err)
-		} else {
-			go func() {
-				responseDB.RequestTime = ud.requestTime
-				responseDB.ResponseTime = time.Now()
-				responseDB.DatabaseID = ud.databaseID
-				responseDB.TableName = ud.tableName
-				err := h.writer.Write(context.Background(), ctx.Req.URL.String(), responseDB)
-				if err != nil {
-					slog.Error("recording response", "error", err, "url", ctx.Req.URL.String(), "status", resp.StatusCode)
-				}
-			}()
+		if h.rewrite && h.ttl > 0 {
+			// the stored response keeps the origin headers
+			resp.Header = resp.Header.Clone()
+			rewriteFreshness(resp.Header, h.ttl)
 		}
+		ud.status.markStored()
+		spool(resp, url, h.maxSize, h.verbose, func(body io.ReadCloser) {
+			responseDB.Body = body
+			h.write(url, responseDB)
+		})
 	}
 	return resp
 }
+
+func (h *responseTTLHandler) write(url string, resp *db.Response) {
+	err := h.writer.Write(context.Background(), url, resp)
+	if err != nil {
+		slog.Error("recording response", "error", err, "url", url, "status", resp.Status)
+	}
+}
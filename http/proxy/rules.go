@@ -0,0 +1,151 @@
+package proxy
+
+import (
+	"net/http"
+	"regexp"
+	"strings"
+
+	"github.com/elazarl/goproxy"
+)
+
+// Rule is the caching policy of the requests matching the host and path
+// globs (* matches any sequence of characters) and the URL regular
+// expression. Unset fields keep the global configuration.
+type Rule struct {
+	Host            string
+	Path            string
+	URL             *regexp.Regexp
+	TTL             *int
+	RFC9111         *bool
+	CacheableStatus []int
+	Bypass          bool   // requests are sent to the origin without using the cache
+	ForceCache      bool   // cache ignoring the origin no-store and private directives
+	Table           string // response table used to store the responses
+	ReadOnly        *bool
+}
+
+// Match reports whether the rule applies to the request
+func (rule *Rule) Match(r *http.Request) bool {
+	if rule.Host != "" && !globMatch(strings.ToLower(rule.Host), strings.ToLower(r.URL.Hostname())) {
+		return false
+	}
+	if rule.Path != "" && !globMatch(rule.Path, r.URL.Path) {
+		return false
+	}
+	if rule.URL != nil && !rule.URL.MatchString(r.URL.String()) {
+		return false
+	}
+	return true
+}
+
+// globMatch matches the string against a pattern where * matches any
+// sequence of characters (including /) and ? matches a single character.
+func globMatch(pattern, s string) bool {
+	p, i := 0, 0
+	star, match := -1, 0
+	for i < len(s) {
+		switch {
+		case p < len(pattern) && (pattern[p] == '?' || pattern[p] == s[i]):
+			p++
+			i++
+		case p < len(pattern) && pattern[p] == '*':
+			star, match = p, i
+			p++
+		case star >= 0:
+			p = star + 1
+			match++
+			i = match
+		default:
+			return false
+		}
+	}
+	for p < len(pattern) && pattern[p] == '*' {
+		p++
+	}
+	return p == len(pattern)
+}
+
+func (rule *Rule) requestConfig(config RequestConfig) RequestConfig {
+	config.Rules = nil
+	if rule.TTL != nil {
+		config.TTL = *rule.TTL
+	}
+	if rule.RFC9111 != nil {
+		config.RFC9111 = *rule.RFC9111
+	}
+	if rule.ForceCache {
+		config.ForceCache = true
+	}
+	if len(rule.CacheableStatus) > 0 {
+		config.CacheableStatus = rule.CacheableStatus
+	}
+	if rule.ReadOnly != nil {
+		config.ReadOnly = *rule.ReadOnly
+	}
+	return config
+}
+
+func (rule *Rule) responseConfig(config ResponseConfig) ResponseConfig {
+	config.Rules = nil
+	if rule.TTL != nil {
+		config.TTL = *rule.TTL
+	}
+	if rule.RFC9111 != nil {
+		config.RFC9111 = *rule.RFC9111
+	}
+	if rule.ForceCache {
+		config.ForceCache = true
+	}
+	return config
+}
+
+// requestRulesHandler dispatches the requests to the handler of the first
+// matching rule, or to the handler of the global configuration.
+type requestRulesHandler struct {
+	rules    []*Rule
+	handlers []goproxy.ReqHandler
+	fallback goproxy.ReqHandler
+	key      KeyFunc
+}
+
+func (h *requestRulesHandler) Handle(r *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+	for i, rule := range h.rules {
+		if !rule.Match(ctx.Req) {
+			continue
+		}
+		if rule.Bypass {
+			ctx.UserData = newCacheStatus(h.key(ctx.Req))
+			return r, nil
+		}
+		r, resp := h.handlers[i].Handle(r, ctx)
+		if ud, ok := ctx.UserData.(userData); ok && rule.Table != "" {
+			ud.tableName = rule.Table
+			ud.variantTableName = rule.Table
+			ctx.UserData = ud
+		}
+		return r, resp
+	}
+	return h.fallback.Handle(r, ctx)
+}
+
+// responseRulesHandler dispatches the responses to the handler of the first
+// rule matching the request, or to the handler of the global configuration.
+// Responses of bypassed and read-only rules are not handled.
+type responseRulesHandler struct {
+	rules    []*Rule
+	handlers []goproxy.RespHandler
+	fallback goproxy.RespHandler
+}
+
+func (h *responseRulesHandler) Handle(resp *http.Response, ctx *goproxy.ProxyCtx) *http.Response {
+	for i, rule := range h.rules {
+		if !rule.Match(ctx.Req) {
+			continue
+		}
+		if rule.Bypass || (rule.ReadOnly != nil && *rule.ReadOnly) {
+			return resp
+		}
+		return h.handlers[i].Handle(resp, ctx)
+	}
+	return h.fallback.Handle(resp, ctx)
+}
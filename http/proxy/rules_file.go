@@ -0,0 +1,85 @@
+package proxy
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+)
+
+// LoadRules reads the TOML rules file, with a [[rule]] table per rule.
+//
+//	[[rule]]
+//	host = "*.example.com"
+//	path = "/api/*"
+//	ttl = 300
+//	status-code = [200, 404]
+//	table = "http_response_api"
+//
+// Keys: host, path, url (regular expression), ttl, rfc9111, status-code,
+// bypass, force-cache, table and read-only.
+func LoadRules(name string) ([]*Rule, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ParseRules(f)
+}
+
+type rulesFile struct {
+	Rules []ruleFile `toml:"rule"`
+}
+
+type ruleFile struct {
+	Host       string `toml:"host"`
+	Path       string `toml:"path"`
+	URL        string `toml:"url"`
+	TTL        *int   `toml:"ttl"`
+	RFC9111    *bool  `toml:"rfc9111"`
+	StatusCode []int  `toml:"status-code"`
+	Bypass     bool   `toml:"bypass"`
+	ForceCache bool   `toml:"force-cache"`
+	Table      string `toml:"table"`
+	ReadOnly   *bool  `toml:"read-only"`
+}
+
+// ParseRules parses rules in the format described by LoadRules
+func ParseRules(r io.Reader) ([]*Rule, error) {
+	var file rulesFile
+	md, err := toml.NewDecoder(r).Decode(&file)
+	if err != nil {
+		return nil, err
+	}
+	if undecoded := md.Undecoded(); len(undecoded) > 0 {
+		keys := make([]string, len(undecoded))
+		for i, key := range undecoded {
+			keys[i] = key.String()
+		}
+		return nil, fmt.Errorf("unknown keys: %s", strings.Join(keys, ", "))
+	}
+	rules := make([]*Rule, len(file.Rules))
+	for i, f := range file.Rules {
+		rule := Rule{
+			Host:            f.Host,
+			Path:            f.Path,
+			TTL:             f.TTL,
+			RFC9111:         f.RFC9111,
+			CacheableStatus: f.StatusCode,
+			Bypass:          f.Bypass,
+			ForceCache:      f.ForceCache,
+			Table:           f.Table,
+			ReadOnly:        f.ReadOnly,
+		}
+		if f.URL != "" {
+			if rule.URL, err = regexp.Compile(f.URL); err != nil {
+				return nil, fmt.Errorf("rule %d: invalid url: %w", i+1, err)
+			}
+		}
+		rules[i] = &rule
+	}
+	return rules, nil
+}
@@ -0,0 +1,201 @@
+package proxy
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/elazarl/goproxy"
+	"github.com/litesql/httpcache/db"
+	"github.com/walterwanderley/sqlite-http-cache/storage"
+)
+
+func TestParseRules(t *testing.T) {
+	rules, err := ParseRules(strings.NewReader(`
+# comment
+[[rule]]
+host = "*.example.com" # trailing comment
+path = "/api/*"
+status-code = [
+  200,
+  404, # not found
+]
+ttl = 60
+table = 'http_response_api'
+
+[[rule]]
+url = '^https://cdn\.example\.com/.*\.js$'
+read-only = true
+rfc9111 = false
+bypass = true
+force-cache = true
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rules) != 2 {
+		t.Fatalf("got %d rules, want 2", len(rules))
+	}
+	first := rules[0]
+	if first.Host != "*.example.com" || first.Path != "/api/*" || first.Table != "http_response_api" {
+		t.Errorf("got host %q, path %q and table %q", first.Host, first.Path, first.Table)
+	}
+	if first.TTL == nil || *first.TTL != 60 {
+		t.Errorf("got ttl %v, want 60", first.TTL)
+	}
+	if fmt.Sprint(first.CacheableStatus) != "[200 404]" {
+		t.Errorf("got status codes %v, want [200 404]", first.CacheableStatus)
+	}
+	if first.RFC9111 != nil || first.ReadOnly != nil || first.URL != nil {
+		t.Error("unset keys of the first rule are set")
+	}
+	second := rules[1]
+	if second.URL == nil || second.URL.String() != `^https://cdn\.example\.com/.*\.js$` {
+		t.Errorf("got url %v", second.URL)
+	}
+	if second.ReadOnly == nil || !*second.ReadOnly || second.RFC9111 == nil || *second.RFC9111 {
+		t.Error("got wrong read-only or rfc9111")
+	}
+	if !second.Bypass || !second.ForceCache {
+		t.Error("got wrong bypass or force-cache")
+	}
+}
+
+func TestParseRulesErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		file string
+	}{
+		{"unknown key", "[[rule]]\nfoo = 1\n"},
+		{"top level key", "ttl = 1\n"},
+		{"wrong type", "[[rule]]\nttl = \"x\"\n"},
+		{"invalid url", "[[rule]]\nurl = \"(\"\n"},
+		{"syntax", "[[rule]\n"},
+	}
+	for _, tt := range tests {
+		if _, err := ParseRules(strings.NewReader(tt.file)); err == nil {
+			t.Errorf("%s: no error", tt.name)
+		}
+	}
+}
+
+func TestRuleMatch(t *testing.T) {
+	rules, err := ParseRules(strings.NewReader(`
+[[rule]]
+host = "*.Example.com"
+path = "/api/v?/*"
+
+[[rule]]
+url = 'debug=1'
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		rule *Rule
+		url  string
+		want bool
+	}{
+		{rules[0], "http://www.example.com/api/v1/users", true},
+		{rules[0], "http://api.example.com:8080/api/v2/a/b", true},
+		{rules[0], "http://example.com/api/v1/users", false},
+		{rules[0], "http://www.example.com/api/v10/users", false},
+		{rules[0], "http://www.example.com/other", false},
+		{rules[1], "http://any.host/p?debug=1", true},
+		{rules[1], "http://any.host/p", false},
+		{&Rule{}, "http://any.host/p", true},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(http.MethodGet, tt.url, nil)
+		if got := tt.rule.Match(r); got != tt.want {
+			t.Errorf("rule %+v match %s = %t, want %t", *tt.rule, tt.url, got, tt.want)
+		}
+	}
+}
+
+func TestRules(t *testing.T) {
+	rules, err := ParseRules(strings.NewReader(`
+[[rule]]
+path = "/bypass/*"
+bypass = true
+
+[[rule]]
+path = "/api/*"
+status-code = [200, 404]
+table = "other"
+force-cache = true
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var hits atomic.Int32
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := hits.Add(1)
+		w.Header().Set("Cache-Control", "no-store")
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprint(w, n)
+	}))
+	defer origin.Close()
+
+	sqlDB, err := sql.Open("sqlite3", "file:"+filepath.Join(t.TempDir(), "test.db")+"?_journal=WAL&_timeout=5000&_txlock=immediate")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sqlDB.Close()
+	if err := db.CreateResponseTables(sqlDB, "http_response", "other"); err != nil {
+		t.Fatal(err)
+	}
+	repo, err := db.NewRepository(sqlDB, 0, 0, "http_response", "other")
+	if err != nil {
+		t.Fatal(err)
+	}
+	writer, err := storage.NewTableWriter([]*sql.DB{sqlDB}, repo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxy := goproxy.NewProxyHttpServer()
+	proxy.OnRequest().Do(NewRequestHandler(RequestConfig{Querier: repo, Writer: writer, RFC9111: true, CacheableStatus: []int{200}, Rules: rules}))
+	proxy.OnResponse().Do(NewResponseHandler(ResponseConfig{Writer: writer, RFC9111: true, Rules: rules}))
+	server := httptest.NewServer(proxy)
+	defer server.Close()
+	proxyURL, _ := url.Parse(server.URL)
+	p := &testProxy{t: t, client: &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)}}, repo: repo, sqlDB: sqlDB}
+
+	for _, path := range []string{"/bypass/a", "/api/a", "/other"} {
+		p.get(origin.URL+path, nil)
+	}
+	stored := func(table string) []string {
+		rows, err := sqlDB.Query("SELECT url FROM " + table)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer rows.Close()
+		var urls []string
+		for rows.Next() {
+			var u string
+			if err := rows.Scan(&u); err != nil {
+				t.Fatal(err)
+			}
+			urls = append(urls, u)
+		}
+		return urls
+	}
+	if got := stored("other"); len(got) != 1 || got[0] != origin.URL+"/api/a" {
+		t.Errorf("got %v in the rule table, want the 404 no-store /api/a", got)
+	}
+	if got := stored("http_response"); len(got) != 0 {
+		t.Errorf("got %v in the default table, want none", got)
+	}
+	if _, body := p.get(origin.URL+"/api/a", nil); body != "2" {
+		t.Errorf("rule: got %q, want the stored response 2", body)
+	}
+	if _, body := p.get(origin.URL+"/bypass/a", nil); body != "4" {
+		t.Errorf("bypass: got %q, want a new response 4", body)
+	}
+}
@@ -0,0 +1,145 @@
+package proxy
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+)
+
+// spoolMemorySize is the size of the body copy kept in memory before
+// moving it to a temporary file
+const spoolMemorySize = 1 << 20
+
+var (
+	// errTooLarge is returned when the body exceeds the maximum object size
+	errTooLarge = errors.New("response body too large")
+	// errIncomplete is returned when the body is closed before its end, usually
+	// because the client disconnected
+	errIncomplete = errors.New("response body not read to the end")
+)
+
+// spool replaces the response body by a reader streaming it to the client
+// while copying it, in memory up to spoolMemorySize bytes and then in a
+// temporary file. When the body is read to the end, store is called with the
+// copy, which must be closed. The copy is discarded if the body is closed
+// before its end, on read errors or when it exceeds maxSize bytes (0 is
+// unlimited).
+func spool(resp *http.Response, url string, maxSize int64, verbose bool, store func(body io.ReadCloser)) {
+	resp.Body = &spoolBody{
+		body:    resp.Body,
+		url:     url,
+		maxSize: maxSize,
+		verbose: verbose,
+		store:   store,
+		buf:     new(bytes.Buffer),
+	}
+}
+
+type spoolBody struct {
+	body    io.ReadCloser
+	url     string
+	maxSize int64
+	verbose bool
+	store   func(io.ReadCloser)
+
+	buf  *bytes.Buffer
+	file *os.File
+	size int64
+	done bool
+}
+
+func (s *spoolBody) Read(p []byte) (int, error) {
+	n, err := s.body.Read(p)
+	if s.done {
+		return n, err
+	}
+	if n > 0 {
+		if copyErr := s.copy(p[:n]); copyErr != nil {
+			s.discard(copyErr)
+			return n, err
+		}
+	}
+	switch {
+	case err == io.EOF:
+		s.complete()
+	case err != nil:
+		s.discard(err)
+	}
+	return n, err
+}
+
+func (s *spoolBody) copy(p []byte) error {
+	s.size += int64(len(p))
+	if s.maxSize > 0 && s.size > s.maxSize {
+		return errTooLarge
+	}
+	if s.file == nil && s.buf.Len()+len(p) > spoolMemorySize {
+		file, err := os.CreateTemp("", "sqlite-http-cache-*")
+		if err != nil {
+			return err
+		}
+		s.file = file
+		if _, err := file.Write(s.buf.Bytes()); err != nil {
+			return err
+		}
+		s.buf = nil
+	}
+	if s.file != nil {
+		_, err := s.file.Write(p)
+		return err
+	}
+	s.buf.Write(p)
+	return nil
+}
+
+func (s *spoolBody) complete() {
+	s.done = true
+	var body io.ReadCloser
+	if s.file != nil {
+		if _, err := s.file.Seek(0, io.SeekStart); err != nil {
+			s.discard(err)
+			return
+		}
+		body = tempFile{s.file}
+		s.file = nil
+	} else {
+		body = io.NopCloser(bytes.NewReader(s.buf.Bytes()))
+	}
+	s.buf = nil
+	s.store(body)
+}
+
+func (s *spoolBody) discard(err error) {
+	s.done = true
+	s.buf = nil
+	if s.file != nil {
+		tempFile{s.file}.Close()
+		s.file = nil
+	}
+	if errors.Is(err, errTooLarge) || errors.Is(err, errIncomplete) {
+		if s.verbose {
+			slog.Info("response not stored", "url", s.url, "reason", err)
+		}
+		return
+	}
+	slog.Error("spooling response body", "error", err, "url", s.url)
+}
+
+func (s *spoolBody) Close() error {
+	if !s.done {
+		s.discard(errIncomplete)
+	}
+	return s.body.Close()
+}
+
+// tempFile is a temporary file removed on Close
+type tempFile struct {
+	*os.File
+}
+
+func (f tempFile) Close() error {
+	return errors.Join(f.File.Close(), os.Remove(f.Name()))
+}
@@ -0,0 +1,176 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/elazarl/goproxy"
+	cachehttp "github.com/litesql/httpcache/http"
+)
+
+// currentAge of the stored response in seconds (RFC 9111 section 4.2.3)
+func currentAge(header http.Header, requestTime time.Time, responseTime time.Time) int {
+	if age := cachehttp.Age(header, requestTime, responseTime); age != nil {
+		return *age
+	}
+	return int(time.Since(responseTime).Seconds())
+}
+
+// revalidateInBackground sends the request to the origin and updates the
+// stored entry, without blocking the client. Only one revalidation per cache
+// key runs at a time. The stale entry is copied, the client response is built
+// from the original one.
+func (h *requestRFC9111Handler) revalidateInBackground(r *http.Request, ctx *goproxy.ProxyCtx, key string, ud userData) {
+	if _, running := h.revalidating.LoadOrStore(key, struct{}{}); running {
+		return
+	}
+
+	req := r.Clone(context.Background())
+	if req.Method == http.MethodHead {
+		req.Method = http.MethodGet
+	}
+	if r.GetBody != nil {
+		req.Body, _ = r.GetBody()
+	}
+	ud.stale = ud.stale.clone()
+	ud.revalidate = addValidators(req, ud.stale.header)
+	ud.staleIfError = false
+	ud.status = nil
+	bgCtx := &goproxy.ProxyCtx{
+		Req:          req,
+		Proxy:        ctx.Proxy,
+		RoundTripper: ctx.RoundTripper,
+		UserData:     ud,
+	}
+	go func() {
+		defer h.revalidating.Delete(key)
+		if !bgCtx.Proxy.KeepHeader {
+			goproxy.RemoveProxyHeaders(bgCtx, req)
+		}
+		resp, err := bgCtx.RoundTrip(req)
+		if err != nil {
+			slog.Error("background revalidation", "error", err, "url", key)
+			return
+		}
+		if h.verbose {
+			slog.Info("background revalidation", "url", key, "status", resp.StatusCode)
+		}
+		resp = h.revalidator.Handle(resp, bgCtx)
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+	}()
+}
+
+const (
+	warningStale              = `110 - "Response is Stale"`
+	warningRevalidationFailed = `111 - "Revalidation Failed"`
+)
+
+// serveStale builds the client response from a stale entry, annotated with a Warning header
+func serveStale(r *http.Request, stale *storedResponse, warning string) *http.Response {
+	resp := serveStored(r, stale.toDB(stale.requestTime, stale.responseTime))
+	if stale.compressed {
+		varyEncoding(resp.Header)
+	}
+	resp.Header.Add("Warning", warning)
+	return resp
+}
+
+// staleIfErrorAllowed reports whether an entry stale for N seconds can be
+// served when the origin fails, according to the configured limit or to the
+// stale-if-error directive (RFC 5861 section 4) of the given headers.
+func staleIfErrorAllowed(limit int, staleFor int, headers ...http.Header) bool {
+	if limit > 0 && staleFor <= limit {
+		return true
+	}
+	for _, header := range headers {
+		if seconds, ok := directiveSeconds(parseDirectives(header), "stale-if-error"); ok && staleFor <= seconds {
+			return true
+		}
+	}
+	return false
+}
+
+// handleOriginErrors replaces the transport errors (connection refused,
+// timeouts...) by an error response with the status returned by the given
+// function, so the response handler can serve the stale entry instead.
+func handleOriginErrors(ctx *goproxy.ProxyCtx, errorStatus func(error) int) {
+	next := ctx.RoundTripper
+	ctx.RoundTripper = goproxy.RoundTripperFunc(func(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Response, error) {
+		var (
+			resp *http.Response
+			err  error
+		)
+		if next != nil {
+			resp, err = next.RoundTrip(req, ctx)
+		} else {
+			resp, err = ctx.Proxy.Tr.RoundTrip(req)
+		}
+		if err == nil {
+			return resp, nil
+		}
+		slog.Error("origin request", "error", err, "url", req.URL.String())
+		status := errorStatus(err)
+		return &http.Response{
+			StatusCode: status,
+			Status:     statusLine(status),
+			Proto:      "HTTP/1.1",
+			ProtoMajor: 1,
+			ProtoMinor: 1,
+			Header:     make(http.Header),
+			Body:       io.NopCloser(strings.NewReader("")),
+			Request:    req,
+		}, nil
+	})
+}
+
+// serveStaleOnOriginError serves the stale entry when the origin fails
+// (transport errors and 5xx responses) directly from the round trip, for the
+// read-only mode where no response handler stores nor serves the entries.
+func serveStaleOnOriginError(ctx *goproxy.ProxyCtx, url string, stale *storedResponse, status *cacheStatus) {
+	next := ctx.RoundTripper
+	ctx.RoundTripper = goproxy.RoundTripperFunc(func(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Response, error) {
+		var (
+			resp *http.Response
+			err  error
+		)
+		if next != nil {
+			resp, err = next.RoundTrip(req, ctx)
+		} else {
+			resp, err = ctx.Proxy.Tr.RoundTrip(req)
+		}
+		switch {
+		case err != nil:
+			slog.Error("origin request", "error", err, "url", req.URL.String())
+			status.forwarded(originErrorStatus(err))
+		case resp.StatusCode >= http.StatusInternalServerError:
+			status.forwarded(resp.StatusCode)
+			resp.Body.Close()
+		default:
+			return resp, nil
+		}
+		slog.Warn("serving stale response on origin error", "url", url)
+		return serveStale(req, stale, warningRevalidationFailed), nil
+	})
+}
+
+// originErrorStatus is 504 (Gateway Timeout) for timeouts and 502 (Bad Gateway) otherwise
+func originErrorStatus(err error) int {
+	var netErr net.Error
+	if errors.Is(err, context.DeadlineExceeded) || (errors.As(err, &netErr) && netErr.Timeout()) {
+		return http.StatusGatewayTimeout
+	}
+	return http.StatusBadGateway
+}
+
+// revalidationFailedStatus is the status sent when an entry that must not be
+// served stale cannot be revalidated (RFC 9111 section 5.2.2.2)
+func revalidationFailedStatus(error) int {
+	return http.StatusGatewayTimeout
+}
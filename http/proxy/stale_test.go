@@ -0,0 +1,137 @@
+package proxy
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestStaleIfErrorAllowed(t *testing.T) {
+	tests := []struct {
+		name     string
+		limit    int
+		staleFor int
+		header   http.Header
+		want     bool
+	}{
+		{"disabled", 0, 10, nil, false},
+		{"within limit", 60, 10, nil, true},
+		{"beyond limit", 60, 61, nil, false},
+		{"directive", 0, 10, http.Header{"Cache-Control": {"max-age=1, stale-if-error=60"}}, true},
+		{"beyond directive", 0, 61, http.Header{"Cache-Control": {"stale-if-error=60"}}, false},
+		{"directive extends limit", 10, 30, http.Header{"Cache-Control": {"stale-if-error=60"}}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := staleIfErrorAllowed(tt.limit, tt.staleFor, tt.header); got != tt.want {
+				t.Errorf("got %t, want %t", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestStaleIfError(t *testing.T) {
+	t.Parallel()
+	for _, rfc9111 := range []bool{false, true} {
+		t.Run(fmt.Sprintf("rfc9111=%t", rfc9111), func(t *testing.T) {
+			t.Parallel()
+			var fail atomic.Bool
+			origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Cache-Control", "max-age=1")
+				if fail.Load() {
+					w.WriteHeader(http.StatusServiceUnavailable)
+					return
+				}
+				fmt.Fprint(w, "v1")
+			}))
+			defer origin.Close()
+			p := newTestProxy(t, RequestConfig{RFC9111: rfc9111, TTL: 1, StaleIfError: 100}, ResponseConfig{RFC9111: rfc9111, TTL: 1})
+
+			p.get(origin.URL+"/x", nil)
+			time.Sleep(2100 * time.Millisecond)
+			fail.Store(true)
+
+			for _, method := range []string{http.MethodGet, http.MethodHead} {
+				resp, body := p.do(method, origin.URL+"/x", nil, nil)
+				if resp.StatusCode != http.StatusOK {
+					t.Fatalf("%s: got %d, want the stale 200", method, resp.StatusCode)
+				}
+				if method == http.MethodGet && body != "v1" {
+					t.Errorf("%s: got body %q, want v1", method, body)
+				}
+				if got := resp.Header.Get("Warning"); got != warningRevalidationFailed {
+					t.Errorf("%s: got Warning %q, want %q", method, got, warningRevalidationFailed)
+				}
+			}
+
+			origin.Close()
+			resp, body := p.get(origin.URL+"/x", nil)
+			if resp.StatusCode != http.StatusOK || body != "v1" {
+				t.Errorf("origin down: got %d %q, want the stale 200 v1", resp.StatusCode, body)
+			}
+		})
+	}
+}
+
+func TestStaleIfErrorDirective(t *testing.T) {
+	t.Parallel()
+	var fail atomic.Bool
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/directive":
+			w.Header().Set("Cache-Control", "max-age=1, stale-if-error=60")
+		default:
+			w.Header().Set("Cache-Control", "max-age=1")
+		}
+		if fail.Load() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		fmt.Fprint(w, "v1")
+	}))
+	defer origin.Close()
+	p := newTestProxy(t, RequestConfig{RFC9111: true}, ResponseConfig{RFC9111: true})
+
+	p.get(origin.URL+"/directive", nil)
+	p.get(origin.URL+"/plain", nil)
+	time.Sleep(2100 * time.Millisecond)
+	fail.Store(true)
+
+	if resp, body := p.get(origin.URL+"/directive", nil); resp.StatusCode != http.StatusOK || body != "v1" {
+		t.Errorf("stale-if-error: got %d %q, want the stale 200 v1", resp.StatusCode, body)
+	}
+	if resp, _ := p.get(origin.URL+"/plain", nil); resp.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("without stale-if-error: got %d, want 503", resp.StatusCode)
+	}
+}
+
+func TestStaleIfErrorReadOnly(t *testing.T) {
+	t.Parallel()
+	var fail atomic.Bool
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=1")
+		if fail.Load() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		fmt.Fprint(w, "v1")
+	}))
+	defer origin.Close()
+	p := newTestProxy(t, RequestConfig{RFC9111: true}, ResponseConfig{RFC9111: true})
+	readOnly := newTestProxy(t, RequestConfig{RFC9111: true, ReadOnly: true, StaleIfError: 100, Querier: p.repo}, ResponseConfig{RFC9111: true})
+
+	p.get(origin.URL+"/x", nil)
+	time.Sleep(2100 * time.Millisecond)
+	fail.Store(true)
+
+	resp, body := readOnly.get(origin.URL+"/x", nil)
+	if resp.StatusCode != http.StatusOK || body != "v1" {
+		t.Errorf("got %d %q, want the stale 200 v1", resp.StatusCode, body)
+	}
+	if got := resp.Header.Get("Warning"); got != warningRevalidationFailed {
+		t.Errorf("got Warning %q, want %q", got, warningRevalidationFailed)
+	}
+}
@@ -0,0 +1,192 @@
+package proxy
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/litesql/httpcache/db"
+	cachehttp "github.com/litesql/httpcache/http"
+)
+
+// storedResponse is a stored response with the body loaded in memory,
+// so it can be served more than once.
+type storedResponse struct {
+	status       int
+	header       http.Header
+	body         []byte
+	requestTime  time.Time
+	responseTime time.Time
+	// compressed is set when the entry was stored compressed by the proxy
+	compressed bool
+}
+
+func newStoredResponse(resp *db.Response) (*storedResponse, error) {
+	compressed := http.Header(resp.Header).Get(storedEncodingHeader) != ""
+	if err := decodeStored(resp); err != nil {
+		return nil, err
+	}
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("reading stored body: %w", err)
+	}
+	resp.Body.Close()
+	return &storedResponse{
+		status:       resp.Status,
+		header:       http.Header(resp.Header).Clone(),
+		body:         body,
+		requestTime:  resp.RequestTime,
+		responseTime: resp.ResponseTime,
+		compressed:   compressed,
+	}, nil
+}
+
+// clone copies the response so it can be updated by another goroutine. The
+// body is never changed and is shared.
+func (s *storedResponse) clone() *storedResponse {
+	c := *s
+	c.header = s.header.Clone()
+	return &c
+}
+
+func (s *storedResponse) toDB(requestTime time.Time, responseTime time.Time) *db.Response {
+	return &db.Response{
+		Status:       s.status,
+		Header:       s.header.Clone(),
+		Body:         io.NopCloser(bytes.NewReader(s.body)),
+		RequestTime:  requestTime,
+		ResponseTime: responseTime,
+	}
+}
+
+// addValidators turns the request into a conditional request using the
+// validators of the stored response. Requests already carrying preconditions
+// from the client are not changed.
+func addValidators(r *http.Request, header http.Header) bool {
+	for _, name := range []string{"If-Match", "If-None-Match", "If-Modified-Since", "If-Unmodified-Since", "If-Range"} {
+		if r.Header.Get(name) != "" {
+			return false
+		}
+	}
+	etag := header.Get("ETag")
+	lastModified := header.Get("Last-Modified")
+	if etag == "" && lastModified == "" {
+		return false
+	}
+	if etag != "" {
+		r.Header.Set("If-None-Match", etag)
+	}
+	if lastModified != "" {
+		r.Header.Set("If-Modified-Since", lastModified)
+	}
+	return true
+}
+
+var hopByHopHeaders = []string{
+	"Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Proxy-Connection",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// mergeHeaders updates the stored headers with the headers of a
+// 304 (Not Modified) response as described in RFC 9111 section 3.2.
+func mergeHeaders(stored http.Header, fresh http.Header) http.Header {
+	merged := stored.Clone()
+	for name, values := range fresh {
+		if name == "Content-Length" || slices.Contains(hopByHopHeaders, name) {
+			continue
+		}
+		merged[name] = slices.Clone(values)
+	}
+	return merged
+}
+
+func statusLine(status int) string {
+	return fmt.Sprintf("%d %s", status, http.StatusText(status))
+}
+
+// serveStored builds the response sent to the client from the stored response.
+func serveStored(r *http.Request, resp *db.Response) *http.Response {
+	header := http.Header(resp.Header)
+	if header.Get("Date") == "" {
+		header.Set("Date", time.Now().Format(time.RFC1123))
+	}
+	if age := cachehttp.Age(header, resp.RequestTime, resp.ResponseTime); age != nil {
+		header.Set("Age", fmt.Sprint(*age))
+	}
+
+	if header.Get(storedEncodingHeader) != "" {
+		varyEncoding(header)
+	}
+
+	encoded := acceptsEncoded(r, header)
+	if status := evalPreconditions(r, resp.Status, header); status != 0 {
+		resp.Body.Close()
+		if encoded {
+			weakETag(header)
+		}
+		return preconditionResponse(r, status, header)
+	}
+
+	if encoded {
+		serveEncoded(header)
+		body := resp.Body
+		if r.Method == http.MethodHead {
+			// the Content-Length of the compressed body sent to GET requests
+			size, err := io.Copy(io.Discard, resp.Body)
+			if err == nil {
+				header.Set("Content-Length", strconv.FormatInt(size, 10))
+			}
+			resp.Body.Close()
+			body = http.NoBody
+		}
+		return &http.Response{
+			StatusCode:    resp.Status,
+			Body:          body,
+			Header:        header,
+			ContentLength: -1,
+			Request:       r,
+		}
+	}
+	if err := decodeStored(resp); err != nil {
+		slog.Error("reading stored body", "error", err)
+	}
+
+	if r.Method == http.MethodGet && resp.Status == http.StatusOK && r.Header.Get("Range") != "" {
+		body, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			slog.Error("reading stored body", "error", err)
+		}
+		return rangeResponse(r, resp.Status, header, body)
+	}
+
+	body := resp.Body
+	if r.Method == http.MethodHead {
+		// headers only, with the Content-Length of the stored GET response
+		size, err := io.Copy(io.Discard, resp.Body)
+		if err == nil {
+			header.Set("Content-Length", strconv.FormatInt(size, 10))
+		}
+		resp.Body.Close()
+		body = http.NoBody
+	}
+
+	return &http.Response{
+		StatusCode: resp.Status,
+		Body:       body,
+		Header:     header,
+		Request:    r,
+	}
+}
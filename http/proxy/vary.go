@@ -0,0 +1,79 @@
+package proxy
+
+import (
+	"context"
+	"database/sql"
+	"net/http"
+	neturl "net/url"
+	"slices"
+	"strings"
+
+	"github.com/litesql/httpcache/db"
+)
+
+// varyFields returns the canonical, sorted and deduplicated list of request
+// header names selected by the Vary header. A Vary of "*" is returned as the
+// single element "*".
+func varyFields(header http.Header) []string {
+	fields := make([]string, 0)
+	for _, value := range header.Values("Vary") {
+		for _, field := range strings.Split(value, ",") {
+			field = strings.TrimSpace(field)
+			if field == "" {
+				continue
+			}
+			if field == "*" {
+				return []string{"*"}
+			}
+			field = http.CanonicalHeaderKey(field)
+			if !slices.Contains(fields, field) {
+				fields = append(fields, field)
+			}
+		}
+	}
+	slices.Sort(fields)
+	return fields
+}
+
+// varyKey builds the secondary cache key of a variant. The selected request
+// header values are appended to the URL as a fragment, so the variants are
+// purged with the URL.
+func varyKey(url string, fields []string, reqHeader http.Header) string {
+	values := make(neturl.Values)
+	for _, field := range fields {
+		values.Set(strings.ToLower(field), normalizeHeaderValues(reqHeader.Values(field)))
+	}
+	return url + "#vary:" + values.Encode()
+}
+
+func normalizeHeaderValues(values []string) string {
+	list := make([]string, 0)
+	for _, value := range values {
+		for _, v := range strings.Split(value, ",") {
+			v = strings.Join(strings.Fields(v), " ")
+			if v != "" {
+				list = append(list, v)
+			}
+		}
+	}
+	return strings.Join(list, ", ")
+}
+
+// lookup finds the stored response for the URL. If the primary entry has a
+// Vary header, the variant matching the request headers is returned instead.
+// The primary entry is returned (when found) to keep track of its location.
+func lookup(ctx context.Context, querier RequestQuerier, url string, reqHeader http.Header) (primary *db.Response, resp *db.Response, err error) {
+	primary, err = querier.FindByURL(ctx, url)
+	if err != nil {
+		return nil, nil, err
+	}
+	fields := varyFields(http.Header(primary.Header))
+	if len(fields) == 0 {
+		return primary, primary, nil
+	}
+	if fields[0] == "*" {
+		return primary, nil, sql.ErrNoRows
+	}
+	resp, err = querier.FindByURL(ctx, varyKey(url, fields, reqHeader))
+	return primary, resp, err
+}
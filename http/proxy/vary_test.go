@@ -0,0 +1,81 @@
+package proxy
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"sync/atomic"
+	"testing"
+)
+
+func TestVaryFields(t *testing.T) {
+	tests := []struct {
+		vary []string
+		want []string
+	}{
+		{nil, []string{}},
+		{[]string{"accept-encoding, Accept"}, []string{"Accept", "Accept-Encoding"}},
+		{[]string{"Accept", "accept, , User-Agent"}, []string{"Accept", "User-Agent"}},
+		{[]string{"Accept, *"}, []string{"*"}},
+	}
+	for _, tt := range tests {
+		header := http.Header{"Vary": tt.vary}
+		if got := varyFields(header); !slices.Equal(got, tt.want) {
+			t.Errorf("varyFields(%q) = %q, want %q", tt.vary, got, tt.want)
+		}
+	}
+}
+
+func TestVaryKey(t *testing.T) {
+	fields := []string{"Accept", "Accept-Language"}
+	a := varyKey("http://example.com/x", fields, http.Header{
+		"Accept":          {"text/html,  application/json"},
+		"Accept-Language": {"en"},
+	})
+	b := varyKey("http://example.com/x", fields, http.Header{
+		"Accept":          {"text/html", "application/json"},
+		"Accept-Language": {"en"},
+	})
+	if a != b {
+		t.Errorf("equivalent headers got different keys %q and %q", a, b)
+	}
+	want := "http://example.com/x#vary:accept=text%2Fhtml%2C+application%2Fjson&accept-language=en"
+	if a != want {
+		t.Errorf("got key %q, want %q", a, want)
+	}
+	c := varyKey("http://example.com/x", fields, http.Header{"Accept": {"text/html"}})
+	if c == a {
+		t.Errorf("different headers got the same key %q", c)
+	}
+}
+
+func TestVaryVariants(t *testing.T) {
+	var hits atomic.Int32
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Header().Set("Vary", "Accept")
+		fmt.Fprintf(w, "accept=%s", r.Header.Get("Accept"))
+	}))
+	defer origin.Close()
+	p := newTestProxy(t, RequestConfig{RFC9111: true}, ResponseConfig{RFC9111: true})
+
+	for range 2 {
+		for _, accept := range []string{"text/plain", "application/json"} {
+			_, body := p.get(origin.URL+"/x", map[string]string{"Accept": accept})
+			if want := "accept=" + accept; body != want {
+				t.Errorf("got body %q, want %q", body, want)
+			}
+		}
+	}
+	if n := hits.Load(); n != 2 {
+		t.Errorf("origin got %d requests, want 2", n)
+	}
+	for _, accept := range []string{"text/plain", "application/json"} {
+		key := varyKey(origin.URL+"/x", []string{"Accept"}, http.Header{"Accept": {accept}})
+		if n := p.stored(key); n != 1 {
+			t.Errorf("%s: %d stored variants, want 1", accept, n)
+		}
+	}
+}
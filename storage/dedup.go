@@ -0,0 +1,420 @@
+package storage
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/litesql/httpcache/db"
+)
+
+// blobTable stores the response bodies of every response table of a
+// database, keyed by the SHA-256 of the body
+const blobTable = "response_blob"
+
+// EnableDedup prepares the response tables to reference bodies stored in the
+// blob table. The reference count of each blob is kept by triggers, so
+// blobs are deleted with the last response row referencing them (purge,
+// cleanup or any DELETE). Bodies written by other writers (the refresh
+// tool) are stored in the response table as usual.
+func EnableDedup(sqlDB *sql.DB, tableNames ...string) error {
+	_, err := sqlDB.Exec(fmt.Sprintf(`CREATE TABLE IF NOT EXISTS %s(
+		hash TEXT PRIMARY KEY,
+		body BLOB,
+		refcount INTEGER NOT NULL DEFAULT 0
+		)`, blobTable))
+	if err != nil {
+		return fmt.Errorf("creating table %q: %w", blobTable, err)
+	}
+	for _, tableName := range tableNames {
+		if !db.TableNameValid(tableName) {
+			return fmt.Errorf("table name %q is invalid", tableName)
+		}
+		var exists bool
+		err := sqlDB.QueryRow("SELECT count(*) > 0 FROM PRAGMA_TABLE_INFO(?) WHERE lower(name) = 'body_hash'", tableName).Scan(&exists)
+		if err != nil {
+			return fmt.Errorf("list columns of %q: %w", tableName, err)
+		}
+		if !exists {
+			if _, err := sqlDB.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN body_hash TEXT", tableName)); err != nil {
+				return fmt.Errorf("adding body_hash column to %q: %w", tableName, err)
+			}
+		}
+		for _, trigger := range dedupTriggers(tableName) {
+			if _, err := sqlDB.Exec(trigger); err != nil {
+				return fmt.Errorf("creating triggers on %q: %w", tableName, err)
+			}
+		}
+	}
+	return nil
+}
+
+func dedupTriggers(tableName string) []string {
+	release := fmt.Sprintf(`UPDATE %[1]s SET refcount = refcount - 1 WHERE hash = old.body_hash;
+		DELETE FROM %[1]s WHERE hash = old.body_hash AND refcount <= 0;`, blobTable)
+	return []string{
+		fmt.Sprintf(`CREATE TRIGGER IF NOT EXISTS %[1]s_blob_insert AFTER INSERT ON %[1]s
+		WHEN new.body_hash IS NOT NULL BEGIN
+		UPDATE %[2]s SET refcount = refcount + 1 WHERE hash = new.body_hash;
+		END`, tableName, blobTable),
+		fmt.Sprintf(`CREATE TRIGGER IF NOT EXISTS %[1]s_blob_update AFTER UPDATE OF body_hash ON %[1]s
+		WHEN old.body_hash IS NOT new.body_hash BEGIN
+		UPDATE %[2]s SET refcount = refcount + 1 WHERE hash = new.body_hash;
+		%[3]s
+		END`, tableName, blobTable, release),
+		fmt.Sprintf(`CREATE TRIGGER IF NOT EXISTS %[1]s_blob_delete AFTER DELETE ON %[1]s
+		WHEN old.body_hash IS NOT NULL BEGIN
+		%[2]s
+		END`, tableName, release),
+		// a body written in the row replaces the referenced blob
+		fmt.Sprintf(`CREATE TRIGGER IF NOT EXISTS %[1]s_blob_inline AFTER UPDATE OF body ON %[1]s
+		WHEN new.body IS NOT NULL AND new.body_hash IS NOT NULL BEGIN
+		UPDATE %[1]s SET body_hash = NULL WHERE rowid = new.rowid;
+		END`, tableName),
+	}
+}
+
+type dedupTable struct {
+	name    string
+	reader  *sql.Stmt
+	writer  *sql.Stmt
+	cleaner *sql.Stmt
+}
+
+type dedupDatabase struct {
+	db        *sql.DB
+	blobWrite *sql.Stmt
+	tables    []*dedupTable
+}
+
+// DedupRepository reads and writes responses with the bodies stored once
+// per database in the blob table.
+type DedupRepository struct {
+	dbs []*dedupDatabase
+	ttl int64 // time to live in seconds
+
+	// roundRobin strategy to choose the database
+	current int
+	mu      sync.Mutex
+
+	cleanupCancelation func()
+}
+
+// NewDedupRepository enables the deduplicated layout on the response tables
+// discovered on each database. Rows older than the TTL are deleted every
+// cleanupInterval, releasing their blobs.
+func NewDedupRepository(dbs []*sql.DB, ttl time.Duration, cleanupInterval time.Duration) (*DedupRepository, error) {
+	repository := DedupRepository{
+		dbs: make([]*dedupDatabase, len(dbs)),
+		ttl: int64(ttl.Seconds()),
+	}
+	for i, sqlDB := range dbs {
+		tables, err := db.ResponseTables(sqlDB)
+		if err != nil {
+			return nil, fmt.Errorf("discovery response tables on database %d: %w", i, err)
+		}
+		if err := EnableDedup(sqlDB, tables...); err != nil {
+			return nil, err
+		}
+		blobWrite, err := sqlDB.Prepare(fmt.Sprintf("INSERT INTO %s(hash, body) VALUES(?, ?) ON CONFLICT(hash) DO NOTHING", blobTable))
+		if err != nil {
+			return nil, fmt.Errorf("prepare blob writer query: %w", err)
+		}
+		database := dedupDatabase{
+			db:        sqlDB,
+			blobWrite: blobWrite,
+		}
+		for _, tableName := range tables {
+			table := dedupTable{name: tableName}
+			if table.reader, err = sqlDB.Prepare(dedupReaderQuery(tableName)); err != nil {
+				return nil, fmt.Errorf("prepare reader query for %q: %w", tableName, err)
+			}
+			if table.writer, err = sqlDB.Prepare(dedupWriterQuery(tableName)); err != nil {
+				return nil, fmt.Errorf("prepare writer query for %q: %w", tableName, err)
+			}
+			if table.cleaner, err = sqlDB.Prepare(cleanupQuery(tableName)); err != nil {
+				return nil, fmt.Errorf("prepare cleanup query for %q: %w", tableName, err)
+			}
+			database.tables = append(database.tables, &table)
+		}
+		repository.dbs[i] = &database
+	}
+
+	if cleanupInterval > 0 && ttl > 0 {
+		ctx, cancel := context.WithCancel(context.Background())
+		repository.cleanupCancelation = cancel
+		slog.Info("Repository cleanup started", "ttl", ttl, "interval", cleanupInterval)
+		go func() {
+			ticker := time.NewTicker(cleanupInterval)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-ticker.C:
+					repository.cleanup()
+				case <-ctx.Done():
+					return
+				}
+			}
+		}()
+	}
+	return &repository, nil
+}
+
+// HasTable reports whether any database has the response table
+func (r *DedupRepository) HasTable(tableName string) bool {
+	for _, database := range r.dbs {
+		if database.table(tableName) != nil {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *DedupRepository) FindByURL(ctx context.Context, url string) (*db.Response, error) {
+	for i, database := range r.dbs {
+		resp, err := database.find(ctx, url)
+		if errors.Is(err, sql.ErrNoRows) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		resp.DatabaseID = i
+		return resp, nil
+	}
+	return nil, sql.ErrNoRows
+}
+
+// Database returns a querier looking up the responses only in the database
+func (r *DedupRepository) Database(databaseID int) ResponseQuerier {
+	return r.dbs[databaseID]
+}
+
+// FindByURL looks up the response in the response tables of the database
+func (d *dedupDatabase) FindByURL(ctx context.Context, url string) (*db.Response, error) {
+	return d.find(ctx, url)
+}
+
+func (d *dedupDatabase) find(ctx context.Context, url string) (*db.Response, error) {
+	for _, table := range d.tables {
+		var (
+			status       int
+			body         []byte
+			header       string
+			requestTime  time.Time
+			responseTime time.Time
+		)
+		err := table.reader.QueryRowContext(ctx, url).Scan(&status, &body, &header, &requestTime, &responseTime)
+		if errors.Is(err, sql.ErrNoRows) {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("scan response row: %w", err)
+		}
+		var headerMap map[string][]string
+		json.Unmarshal([]byte(header), &headerMap)
+		return &db.Response{
+			Status:       status,
+			Body:         io.NopCloser(strings.NewReader(string(body))),
+			Header:       headerMap,
+			RequestTime:  requestTime,
+			ResponseTime: responseTime,
+			TableName:    table.name,
+		}, nil
+	}
+	return nil, sql.ErrNoRows
+}
+
+// Write stores the body in the blob table and the response in its table
+// (the first table of the database when not set). The URL is deleted from
+// the other response tables of the database.
+func (r *DedupRepository) Write(ctx context.Context, url string, resp *db.Response) error {
+	_, err := r.WriteBatch(ctx, []Entry{{URL: url, Response: resp}})
+	return err
+}
+
+// WriteBatch stores the responses with a transaction per database
+func (r *DedupRepository) WriteBatch(ctx context.Context, entries []Entry) (int, error) {
+	var (
+		written int
+		errs    error
+	)
+	perDatabase := make(map[*dedupDatabase][]Entry)
+	tables := make(map[*db.Response]*dedupTable)
+	for _, entry := range entries {
+		database, table, err := r.location(entry.Response)
+		if err != nil {
+			entry.Response.Body.Close()
+			errs = errors.Join(errs, err)
+			continue
+		}
+		// the responses written get the database and table used
+		entry.Response.DatabaseID = slices.Index(r.dbs, database)
+		entry.Response.TableName = table.name
+		perDatabase[database] = append(perDatabase[database], entry)
+		tables[entry.Response] = table
+	}
+	for database, entries := range perDatabase {
+		n, err := r.writeTx(ctx, database, entries, tables)
+		written += n
+		errs = errors.Join(errs, err)
+	}
+	return written, errs
+}
+
+func (r *DedupRepository) writeTx(ctx context.Context, database *dedupDatabase, entries []Entry, tables map[*db.Response]*dedupTable) (int, error) {
+	defer closeBodies(entries)
+	tx, err := database.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, fmt.Errorf("begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+	var (
+		written int
+		errs    error
+	)
+	for _, entry := range entries {
+		err := inSavepoint(ctx, tx, func() error {
+			return database.writeEntry(ctx, tx, tables[entry.Response], entry)
+		})
+		if err != nil {
+			errs = errors.Join(errs, err)
+			continue
+		}
+		written++
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, fmt.Errorf("commit: %w", err)
+	}
+	return written, errs
+}
+
+func (d *dedupDatabase) writeEntry(ctx context.Context, tx *sql.Tx, table *dedupTable, entry Entry) error {
+	body, err := io.ReadAll(entry.Response.Body)
+	if err != nil {
+		return fmt.Errorf("reading body: %w", err)
+	}
+	hash := sha256.Sum256(body)
+	bodyHash := hex.EncodeToString(hash[:])
+	header, err := json.Marshal(entry.Response.Header)
+	if err != nil {
+		return fmt.Errorf("encoding header: %w", err)
+	}
+
+	if _, err := tx.StmtContext(ctx, d.blobWrite).ExecContext(ctx, bodyHash, body); err != nil {
+		return fmt.Errorf("store body: %w", err)
+	}
+	for _, other := range d.tables {
+		if other == table {
+			continue
+		}
+		if _, err := tx.ExecContext(ctx, "DELETE FROM "+other.name+" WHERE url = ?", entry.URL); err != nil {
+			return err
+		}
+	}
+	_, err = tx.StmtContext(ctx, table.writer).ExecContext(ctx, entry.URL, entry.Response.Status, string(header),
+		entry.Response.RequestTime.Format(time.RFC3339Nano), entry.Response.ResponseTime.Format(time.RFC3339Nano), bodyHash)
+	if err != nil {
+		return fmt.Errorf("store response: %w", err)
+	}
+	return nil
+}
+
+func (r *DedupRepository) location(resp *db.Response) (*dedupDatabase, *dedupTable, error) {
+	if resp.DatabaseID >= 0 && resp.DatabaseID < len(r.dbs) {
+		database := r.dbs[resp.DatabaseID]
+		if resp.TableName == "" {
+			return database, database.tables[0], nil
+		}
+		if table := database.table(resp.TableName); table != nil {
+			return database, table, nil
+		}
+		return nil, nil, fmt.Errorf("response table %q not found in database %d", resp.TableName, resp.DatabaseID)
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for range r.dbs {
+		r.current = (r.current + 1) % len(r.dbs)
+		database := r.dbs[r.current]
+		if resp.TableName == "" {
+			return database, database.tables[0], nil
+		}
+		if table := database.table(resp.TableName); table != nil {
+			return database, table, nil
+		}
+	}
+	return nil, nil, fmt.Errorf("response table %q not found", resp.TableName)
+}
+
+func (d *dedupDatabase) table(name string) *dedupTable {
+	for _, table := range d.tables {
+		if table.name == name {
+			return table
+		}
+	}
+	return nil
+}
+
+func (r *DedupRepository) cleanup() {
+	for _, database := range r.dbs {
+		for _, table := range database.tables {
+			for {
+				res, err := table.cleaner.Exec(r.ttl)
+				if err != nil {
+					slog.Error("cleanup", "error", err, "table", table.name)
+					break
+				}
+				rowsAffected, err := res.RowsAffected()
+				if err != nil || rowsAffected == 0 {
+					break
+				}
+			}
+		}
+	}
+}
+
+func (r *DedupRepository) Close() error {
+	if r.cleanupCancelation != nil {
+		r.cleanupCancelation()
+	}
+	var err error
+	for _, database := range r.dbs {
+		err = errors.Join(err, database.blobWrite.Close())
+		for _, table := range database.tables {
+			err = errors.Join(err, table.reader.Close(), table.writer.Close(), table.cleaner.Close())
+		}
+	}
+	return err
+}
+
+func dedupReaderQuery(tableName string) string {
+	return fmt.Sprintf(`SELECT r.status, COALESCE(r.body, b.body, ''), r.header, r.request_time, r.response_time
+		FROM %s AS r LEFT JOIN %s AS b ON b.hash = r.body_hash
+		WHERE r.url = ?`, tableName, blobTable)
+}
+
+func dedupWriterQuery(tableName string) string {
+	return fmt.Sprintf(`INSERT INTO %s(url, status, body, header, request_time, response_time, body_hash)
+		VALUES(?1, ?2, NULL, ?3, ?4, ?5, ?6)
+		ON CONFLICT(url) DO UPDATE SET
+		status = ?2,
+		body = NULL,
+		header = ?3,
+		request_time = ?4,
+		response_time = ?5,
+		body_hash = ?6`, tableName)
+}
+
+func cleanupQuery(tableName string) string {
+	return fmt.Sprintf("DELETE FROM %s WHERE rowid IN (SELECT rowid FROM %s WHERE unixepoch() - unixepoch(response_time) > ? ORDER BY rowid LIMIT 1000)", tableName, tableName)
+}
@@ -0,0 +1,157 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"testing"
+	"time"
+
+	"github.com/litesql/httpcache/db"
+)
+
+func TestDedupRepository(t *testing.T) {
+	ctx := context.Background()
+	sqlDB := openTestDB(t)
+	repo, err := NewDedupRepository([]*sql.DB{sqlDB}, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer repo.Close()
+	refcount := func(url string) int {
+		t.Helper()
+		var n int
+		err := sqlDB.QueryRow("SELECT b.refcount FROM http_response r JOIN response_blob b ON b.hash = r.body_hash WHERE r.url = ?", url).Scan(&n)
+		if err != nil {
+			t.Fatal(url, err)
+		}
+		return n
+	}
+
+	now := time.Now()
+	for url, body := range map[string]string{"http://x/a": "same", "http://x/b": "same", "http://x/c": "other"} {
+		resp := newTestResponse(body, now)
+		if err := repo.Write(ctx, url, resp); err != nil {
+			t.Fatal(err)
+		}
+		if resp.DatabaseID != 0 || resp.TableName != "http_response" {
+			t.Errorf("%s: written to %d %q, want 0 http_response", url, resp.DatabaseID, resp.TableName)
+		}
+	}
+	if n := countRows(t, sqlDB, blobTable, ""); n != 2 {
+		t.Errorf("got %d blobs, want 2", n)
+	}
+	if n := refcount("http://x/a"); n != 2 {
+		t.Errorf("got refcount %d of the shared body, want 2", n)
+	}
+	resp, err := repo.FindByURL(ctx, "http://x/b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if body := readBody(t, resp); body != "same" || resp.Header["Content-Type"][0] != "text/plain" {
+		t.Errorf("got body %q and header %v", body, resp.Header)
+	}
+
+	// the overwritten body is released
+	if err := repo.Write(ctx, "http://x/a", newTestResponse("other", now)); err != nil {
+		t.Fatal(err)
+	}
+	if n := refcount("http://x/b"); n != 1 {
+		t.Errorf("got refcount %d of the released body, want 1", n)
+	}
+	if n := refcount("http://x/a"); n != 2 {
+		t.Errorf("got refcount %d of the new body, want 2", n)
+	}
+
+	// the blob is deleted with the last response referencing it
+	purger, err := NewPurger([]*sql.DB{sqlDB})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer purger.Close()
+	if err := purger.Purge(ctx, "http://x/b"); err != nil {
+		t.Fatal(err)
+	}
+	if n := countRows(t, sqlDB, blobTable, ""); n != 1 {
+		t.Errorf("got %d blobs after purge, want 1", n)
+	}
+
+	// a body written in the row by the library writer replaces the blob
+	_, err = sqlDB.Exec(db.WriterQuery("http_response"), "http://x/c", 200, "inline", "{}",
+		now.Format(time.RFC3339Nano), now.Format(time.RFC3339Nano), 200, "inline", "{}",
+		now.Format(time.RFC3339Nano), now.Format(time.RFC3339Nano))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err = repo.FindByURL(ctx, "http://x/c")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if body := readBody(t, resp); body != "inline" {
+		t.Errorf("got body %q, want the inline body", body)
+	}
+	if n := refcount("http://x/a"); n != 1 {
+		t.Errorf("got refcount %d after the inline write, want 1", n)
+	}
+}
+
+func TestDedupRepositoryCleanup(t *testing.T) {
+	ctx := context.Background()
+	sqlDB := openTestDB(t)
+	repo, err := NewDedupRepository([]*sql.DB{sqlDB}, time.Hour, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer repo.Close()
+	if err := repo.Write(ctx, "http://x/old", newTestResponse("old", time.Now().Add(-2*time.Hour))); err != nil {
+		t.Fatal(err)
+	}
+	if err := repo.Write(ctx, "http://x/new", newTestResponse("new", time.Now())); err != nil {
+		t.Fatal(err)
+	}
+	repo.cleanup()
+	if _, err := repo.FindByURL(ctx, "http://x/old"); err != sql.ErrNoRows {
+		t.Errorf("got %v for the expired response, want sql.ErrNoRows", err)
+	}
+	if _, err := repo.FindByURL(ctx, "http://x/new"); err != nil {
+		t.Errorf("got %v for the fresh response", err)
+	}
+	if n := countRows(t, sqlDB, blobTable, ""); n != 1 {
+		t.Errorf("got %d blobs after cleanup, want 1", n)
+	}
+}
+
+func TestDedupRepositoryTables(t *testing.T) {
+	ctx := context.Background()
+	sqlDB := openTestDB(t, "http_response", "other")
+	repo, err := NewDedupRepository([]*sql.DB{sqlDB}, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer repo.Close()
+	if !repo.HasTable("other") || repo.HasTable("missing") {
+		t.Error("wrong tables")
+	}
+	if err := repo.Write(ctx, "http://x/a", newTestResponse("v1", time.Now())); err != nil {
+		t.Fatal(err)
+	}
+	resp := newTestResponse("v2", time.Now())
+	resp.TableName = "other"
+	if err := repo.Write(ctx, "http://x/a", resp); err != nil {
+		t.Fatal(err)
+	}
+	if n := countRows(t, sqlDB, "http_response", ""); n != 0 {
+		t.Errorf("got %d responses left in the previous table, want 0", n)
+	}
+	found, err := repo.FindByURL(ctx, "http://x/a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if body := readBody(t, found); body != "v2" || found.TableName != "other" {
+		t.Errorf("got %q from %q, want v2 from other", body, found.TableName)
+	}
+	resp = newTestResponse("v3", time.Now())
+	resp.TableName = "missing"
+	if err := repo.Write(ctx, "http://x/a", resp); err == nil {
+		t.Error("write to a missing table succeeded")
+	}
+}
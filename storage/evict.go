@@ -0,0 +1,384 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/litesql/httpcache/db"
+)
+
+// EvictionPolicy chooses the responses deleted when a database exceeds its limits
+type EvictionPolicy string
+
+const (
+	LRU    EvictionPolicy = "lru"    // least recently used first
+	LFU    EvictionPolicy = "lfu"    // least frequently used first
+	Oldest EvictionPolicy = "oldest" // oldest response time first
+)
+
+// evictionBatch is the maximum number of responses deleted per statement batch
+const evictionBatch = 1000
+
+// EvictionConfig sets the limits of each database
+type EvictionConfig struct {
+	MaxBytes int64 // used pages of the database file, 0 is unlimited
+	MaxRows  int64 // responses of all response tables, 0 is unlimited
+	Policy   EvictionPolicy
+	Interval time.Duration
+	// Invalidator removes the evicted responses from the cache in front of
+	// the databases (MemoryCache), nil when there is none
+	Invalidator Invalidator
+}
+
+// Invalidator removes a URL and its secondary keys from a cache
+type Invalidator interface {
+	Invalidate(url string)
+}
+
+type evictionDatabase struct {
+	db     *sql.DB
+	tables []string
+}
+
+type hitKey struct {
+	databaseID int
+	tableName  string
+	url        string
+}
+
+type hit struct {
+	count      int64
+	lastAccess time.Time
+}
+
+// Evictor deletes responses in the background when a database exceeds its
+// size limits, following the eviction policy. Hits are recorded in memory
+// by the querier returned by Querier and saved on each run.
+type Evictor struct {
+	dbs    []*evictionDatabase
+	config EvictionConfig
+
+	hits map[hitKey]hit
+	mu   sync.Mutex
+
+	cancel func()
+	done   chan struct{}
+}
+
+// NewEvictor adds the hits and last_access columns to the response tables
+// discovered on each database and starts the eviction loop.
+func NewEvictor(dbs []*sql.DB, config EvictionConfig) (*Evictor, error) {
+	switch config.Policy {
+	case "":
+		config.Policy = LRU
+	case LRU, LFU, Oldest:
+	default:
+		return nil, fmt.Errorf("invalid eviction policy %q", config.Policy)
+	}
+	if config.Interval <= 0 {
+		config.Interval = time.Minute
+	}
+	evictor := Evictor{
+		dbs:    make([]*evictionDatabase, len(dbs)),
+		config: config,
+		hits:   make(map[hitKey]hit),
+		done:   make(chan struct{}),
+	}
+	for i, sqlDB := range dbs {
+		tables, err := db.ResponseTables(sqlDB)
+		if err != nil {
+			return nil, fmt.Errorf("discovery response tables on database %d: %w", i, err)
+		}
+		for _, tableName := range tables {
+			if err := addColumn(sqlDB, tableName, "hits", "INTEGER NOT NULL DEFAULT 0"); err != nil {
+				return nil, err
+			}
+			if err := addColumn(sqlDB, tableName, "last_access", "DATETIME"); err != nil {
+				return nil, err
+			}
+		}
+		evictor.dbs[i] = &evictionDatabase{
+			db:     sqlDB,
+			tables: tables,
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	evictor.cancel = cancel
+	slog.Info("Eviction started", "policy", config.Policy, "max-bytes", config.MaxBytes, "max-rows", config.MaxRows, "interval", config.Interval)
+	go func() {
+		defer close(evictor.done)
+		ticker := time.NewTicker(config.Interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				evictor.run(ctx)
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return &evictor, nil
+}
+
+func addColumn(sqlDB *sql.DB, tableName, column, definition string) error {
+	var exists bool
+	err := sqlDB.QueryRow("SELECT count(*) > 0 FROM PRAGMA_TABLE_INFO(?) WHERE lower(name) = ?", tableName, column).Scan(&exists)
+	if err != nil {
+		return fmt.Errorf("list columns of %q: %w", tableName, err)
+	}
+	if exists {
+		return nil
+	}
+	if _, err := sqlDB.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", tableName, column, definition)); err != nil {
+		return fmt.Errorf("adding %s column to %q: %w", column, tableName, err)
+	}
+	return nil
+}
+
+// ResponseQuerier finds stored responses
+type ResponseQuerier interface {
+	FindByURL(ctx context.Context, url string) (*db.Response, error)
+}
+
+type hitQuerier struct {
+	next    ResponseQuerier
+	evictor *Evictor
+}
+
+// Querier returns a querier recording the hits of the responses found by next
+func (e *Evictor) Querier(next ResponseQuerier) ResponseQuerier {
+	return &hitQuerier{
+		next:    next,
+		evictor: e,
+	}
+}
+
+func (q *hitQuerier) FindByURL(ctx context.Context, url string) (*db.Response, error) {
+	resp, err := q.next.FindByURL(ctx, url)
+	if err == nil && resp != nil {
+		q.evictor.hit(resp.DatabaseID, resp.TableName, url)
+	}
+	return resp, err
+}
+
+func (e *Evictor) hit(databaseID int, tableName, url string) {
+	if databaseID < 0 || databaseID >= len(e.dbs) {
+		return
+	}
+	key := hitKey{databaseID: databaseID, tableName: tableName, url: url}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	h := e.hits[key]
+	h.count++
+	h.lastAccess = time.Now()
+	e.hits[key] = h
+}
+
+func (e *Evictor) run(ctx context.Context) {
+	if err := e.saveHits(ctx); err != nil {
+		slog.Error("saving hits", "error", err)
+	}
+	for i, database := range e.dbs {
+		if err := e.evict(ctx, database); err != nil {
+			slog.Error("eviction", "error", err, "database", i)
+		}
+	}
+}
+
+// saveHits adds the hits recorded since the last run to the response tables
+func (e *Evictor) saveHits(ctx context.Context) error {
+	e.mu.Lock()
+	hits := e.hits
+	e.hits = make(map[hitKey]hit)
+	e.mu.Unlock()
+	if len(hits) == 0 {
+		return nil
+	}
+
+	perDatabase := make(map[int]map[hitKey]hit)
+	for key, h := range hits {
+		if perDatabase[key.databaseID] == nil {
+			perDatabase[key.databaseID] = make(map[hitKey]hit)
+		}
+		perDatabase[key.databaseID][key] = h
+	}
+	var err error
+	for databaseID, hits := range perDatabase {
+		err = errors.Join(err, e.dbs[databaseID].saveHits(ctx, hits))
+	}
+	return err
+}
+
+func (d *evictionDatabase) saveHits(ctx context.Context, hits map[hitKey]hit) error {
+	tx, err := d.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+	for key, h := range hits {
+		tables := d.tables
+		if key.tableName != "" {
+			tables = []string{key.tableName}
+		}
+		for _, tableName := range tables {
+			_, err := tx.ExecContext(ctx, fmt.Sprintf("UPDATE %s SET hits = hits + ?, last_access = ? WHERE url = ?", tableName),
+				h.count, h.lastAccess.Format(time.RFC3339Nano), key.url)
+			if err != nil {
+				return fmt.Errorf("update hits: %w", err)
+			}
+		}
+	}
+	return tx.Commit()
+}
+
+// evict deletes responses until the database is under its limits
+func (e *Evictor) evict(ctx context.Context, database *evictionDatabase) error {
+	for ctx.Err() == nil {
+		rows, usedBytes, err := database.usage(ctx)
+		if err != nil {
+			return err
+		}
+		var excess int64
+		if e.config.MaxRows > 0 && rows > e.config.MaxRows {
+			excess = rows - e.config.MaxRows
+		}
+		if e.config.MaxBytes > 0 && usedBytes > e.config.MaxBytes && rows > 0 {
+			// estimate the rows to delete from the average row size
+			excess = max(excess, rows*(usedBytes-e.config.MaxBytes)/usedBytes+1)
+		}
+		if excess == 0 {
+			return nil
+		}
+		deleted, err := database.deleteVictims(ctx, e.config.Policy, min(excess, evictionBatch), e.config.Invalidator)
+		if err != nil {
+			return err
+		}
+		slog.Info("evicted responses", "count", deleted, "rows", rows, "bytes", usedBytes)
+		if deleted == 0 {
+			return nil
+		}
+	}
+	return ctx.Err()
+}
+
+// usage returns the number of responses and the size of the pages in use
+func (d *evictionDatabase) usage(ctx context.Context) (int64, int64, error) {
+	var rows int64
+	for _, tableName := range d.tables {
+		var count int64
+		if err := d.db.QueryRowContext(ctx, "SELECT count(*) FROM "+tableName).Scan(&count); err != nil {
+			return 0, 0, fmt.Errorf("count rows of %q: %w", tableName, err)
+		}
+		rows += count
+	}
+	var usedBytes int64
+	err := d.db.QueryRowContext(ctx, "SELECT (p.page_count - f.freelist_count) * s.page_size FROM pragma_page_count() AS p, pragma_freelist_count() AS f, pragma_page_size() AS s").Scan(&usedBytes)
+	if err != nil {
+		return 0, 0, fmt.Errorf("database size: %w", err)
+	}
+	return rows, usedBytes, nil
+}
+
+// deleteVictims deletes up to limit responses chosen by the policy across
+// the response tables. The secondary keys of a victim are deleted with it.
+// The victims are removed from the invalidator once deleted.
+func (d *evictionDatabase) deleteVictims(ctx context.Context, policy EvictionPolicy, limit int64, invalidator Invalidator) (int64, error) {
+	rows, err := d.db.QueryContext(ctx, victimsQuery(d.tables, policy), limit)
+	if err != nil {
+		return 0, fmt.Errorf("select victims: %w", err)
+	}
+	type victim struct {
+		tableName string
+		url       string
+	}
+	victims := make([]victim, 0)
+	for rows.Next() {
+		var v victim
+		if err := rows.Scan(&v.tableName, &v.url); err != nil {
+			rows.Close()
+			return 0, fmt.Errorf("scan victim: %w", err)
+		}
+		victims = append(victims, v)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, fmt.Errorf("select victims: %w", err)
+	}
+
+	tx, err := d.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, fmt.Errorf("begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+	var deleted int64
+	for _, v := range victims {
+		res, err := tx.ExecContext(ctx, purgeQuery(v.tableName), v.url)
+		if err != nil {
+			return 0, fmt.Errorf("delete victim: %w", err)
+		}
+		n, _ := res.RowsAffected()
+		deleted += n
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, fmt.Errorf("commit: %w", err)
+	}
+	if invalidator != nil {
+		for _, v := range victims {
+			invalidator.Invalidate(v.url)
+		}
+	}
+	return deleted, nil
+}
+
+func victimsQuery(tables []string, policy EvictionPolicy) string {
+	var order string
+	switch policy {
+	case LFU:
+		order = "hits, julianday(COALESCE(last_access, response_time))"
+	case Oldest:
+		order = "julianday(response_time)"
+	default:
+		order = "julianday(COALESCE(last_access, response_time))"
+	}
+	selects := make([]string, len(tables))
+	for i, tableName := range tables {
+		selects[i] = fmt.Sprintf("SELECT '%s' AS table_name, url, hits, last_access, response_time FROM %s", tableName, tableName)
+	}
+	return fmt.Sprintf("SELECT table_name, url FROM (%s) ORDER BY %s LIMIT ?", strings.Join(selects, " UNION ALL "), order)
+}
+
+// Close stops the eviction loop and saves the pending hits
+func (e *Evictor) Close() error {
+	e.cancel()
+	<-e.done
+	return e.saveHits(context.Background())
+}
+
+// ParseSize parses a size in bytes with an optional KB, MB, GB or TB suffix
+// (powers of 1024), e.g. 512MB.
+func ParseSize(s string) (int64, error) {
+	value := strings.ToUpper(strings.TrimSpace(s))
+	multiplier := int64(1)
+	for i, suffix := range []string{"KB", "MB", "GB", "TB"} {
+		if strings.HasSuffix(value, suffix) {
+			value = strings.TrimSpace(strings.TrimSuffix(value, suffix))
+			multiplier = 1 << (10 * (i + 1))
+			break
+		}
+	}
+	value = strings.TrimSuffix(value, "B")
+	n, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	return n * multiplier, nil
+}
@@ -0,0 +1,198 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/litesql/httpcache/db"
+)
+
+// invalidations records the URLs invalidated
+type invalidations []string
+
+func (i *invalidations) Invalidate(url string) {
+	*i = append(*i, url)
+}
+
+// newTestEvictor returns an evictor that only runs when the test calls run
+func newTestEvictor(t *testing.T, dbs []*sql.DB, config EvictionConfig) *Evictor {
+	t.Helper()
+	config.Interval = time.Hour
+	evictor, err := NewEvictor(dbs, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { evictor.Close() })
+	return evictor
+}
+
+func storedURLs(t *testing.T, sqlDB *sql.DB) []string {
+	t.Helper()
+	rows, err := sqlDB.Query("SELECT url FROM http_response ORDER BY url")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	urls := make([]string, 0)
+	for rows.Next() {
+		var url string
+		if err := rows.Scan(&url); err != nil {
+			t.Fatal(err)
+		}
+		urls = append(urls, url)
+	}
+	return urls
+}
+
+func TestEvictorPolicies(t *testing.T) {
+	tests := []struct {
+		policy EvictionPolicy
+		want   []string
+	}{
+		{LRU, []string{"http://x/1", "http://x/6", "http://x/7", "http://x/8", "http://x/9"}},
+		{LFU, []string{"http://x/0", "http://x/1", "http://x/7", "http://x/8", "http://x/9"}},
+		{Oldest, []string{"http://x/5", "http://x/6", "http://x/7", "http://x/8", "http://x/9"}},
+	}
+	for _, tt := range tests {
+		t.Run(string(tt.policy), func(t *testing.T) {
+			ctx := context.Background()
+			sqlDB := openTestDB(t)
+			var invalidated invalidations
+			evictor := newTestEvictor(t, []*sql.DB{sqlDB}, EvictionConfig{MaxRows: 5, Policy: tt.policy, Invalidator: &invalidated})
+			repo, err := db.NewRepository(sqlDB, 0, 0, "http_response")
+			if err != nil {
+				t.Fatal(err)
+			}
+			base := time.Now().Add(-time.Hour)
+			for i := range 10 {
+				if err := repo.Write(ctx, fmt.Sprintf("http://x/%d", i), newTestResponse("body", base.Add(time.Duration(i)*time.Minute))); err != nil {
+					t.Fatal(err)
+				}
+			}
+			// x/0 is the most frequently used and x/1 the most recently used
+			if _, err := sqlDB.Exec("UPDATE http_response SET hits = 5, last_access = ? WHERE url = 'http://x/0'", base.Add(-time.Hour).Format(time.RFC3339Nano)); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := sqlDB.Exec("UPDATE http_response SET hits = 1, last_access = ? WHERE url = 'http://x/1'", time.Now().Format(time.RFC3339Nano)); err != nil {
+				t.Fatal(err)
+			}
+
+			evictor.run(ctx)
+			got := storedURLs(t, sqlDB)
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+			if len(invalidated) != 5 || slices.ContainsFunc(invalidated, func(url string) bool {
+				return slices.Contains(got, url)
+			}) {
+				t.Errorf("got invalidated %v, want the 5 evicted URLs", invalidated)
+			}
+		})
+	}
+}
+
+func TestEvictorSecondaryKeys(t *testing.T) {
+	ctx := context.Background()
+	sqlDB := openTestDB(t)
+	evictor := newTestEvictor(t, []*sql.DB{sqlDB}, EvictionConfig{MaxRows: 1, Policy: Oldest})
+	repo, err := db.NewRepository(sqlDB, 0, 0, "http_response")
+	if err != nil {
+		t.Fatal(err)
+	}
+	base := time.Now().Add(-time.Hour)
+	for i, url := range []string{"http://x/a", "http://x/a#vary:accept=json", "http://x/b"} {
+		if err := repo.Write(ctx, url, newTestResponse("body", base.Add(time.Duration(i)*time.Minute))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	evictor.run(ctx)
+	if got := storedURLs(t, sqlDB); !slices.Equal(got, []string{"http://x/b"}) {
+		t.Errorf("got %v, want the variant evicted with its URL", got)
+	}
+}
+
+func TestEvictorMaxBytes(t *testing.T) {
+	ctx := context.Background()
+	sqlDB := openTestDB(t)
+	repo, err := db.NewRepository(sqlDB, 0, 0, "http_response")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range 200 {
+		if err := repo.Write(ctx, fmt.Sprintf("http://x/%d", i), newTestResponse(strings.Repeat("a", 10000), time.Now())); err != nil {
+			t.Fatal(err)
+		}
+	}
+	const maxBytes = 500 << 10
+	evictor := newTestEvictor(t, []*sql.DB{sqlDB}, EvictionConfig{MaxBytes: maxBytes})
+	evictor.run(ctx)
+	rows, usedBytes, err := evictor.dbs[0].usage(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if usedBytes > maxBytes || rows == 0 {
+		t.Errorf("got %d rows using %d bytes, want under %d bytes", rows, usedBytes, maxBytes)
+	}
+}
+
+func TestEvictorHits(t *testing.T) {
+	ctx := context.Background()
+	sqlDB := openTestDB(t)
+	repo, err := db.NewRepository(sqlDB, 0, 0, "http_response")
+	if err != nil {
+		t.Fatal(err)
+	}
+	evictor := newTestEvictor(t, []*sql.DB{sqlDB}, EvictionConfig{MaxRows: 100})
+	if err := repo.Write(ctx, "http://x/a", newTestResponse("body", time.Now())); err != nil {
+		t.Fatal(err)
+	}
+	querier := evictor.Querier(repo)
+	for range 3 {
+		if _, err := querier.FindByURL(ctx, "http://x/a"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := querier.FindByURL(ctx, "http://x/missing"); !errors.Is(err, sql.ErrNoRows) {
+		t.Fatalf("got %v, want sql.ErrNoRows", err)
+	}
+	evictor.run(ctx)
+	if n := countRows(t, sqlDB, "http_response", "url = 'http://x/a' AND hits = 3 AND last_access IS NOT NULL"); n != 1 {
+		t.Error("hits not saved")
+	}
+}
+
+func TestNewEvictorInvalidPolicy(t *testing.T) {
+	if _, err := NewEvictor(nil, EvictionConfig{Policy: "fifo"}); err == nil {
+		t.Error("invalid policy accepted")
+	}
+}
+
+func TestParseSize(t *testing.T) {
+	tests := []struct {
+		value string
+		want  int64
+		ok    bool
+	}{
+		{"1024", 1024, true},
+		{"512MB", 512 << 20, true},
+		{"2 gb", 2 << 30, true},
+		{"10KB", 10 << 10, true},
+		{"1TB", 1 << 40, true},
+		{"100B", 100, true},
+		{"-1", 0, false},
+		{"x", 0, false},
+		{"", 0, false},
+	}
+	for _, tt := range tests {
+		got, err := ParseSize(tt.value)
+		if (err == nil) != tt.ok || got != tt.want {
+			t.Errorf("ParseSize(%q) = %d, %v, want %d", tt.value, got, err, tt.want)
+		}
+	}
+}
@@ -0,0 +1,327 @@
+package storage
+
+import (
+	"bytes"
+	"container/list"
+	"context"
+	"errors"
+	"expvar"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/litesql/httpcache/db"
+)
+
+// memoryObjectRatio limits the size of each response kept in memory to a
+// fraction of the memory cache, so a few large bodies don't evict the others
+const memoryObjectRatio = 8
+
+// MemoryCache keeps the most recently used responses in memory, up to
+// maxBytes (bodies, keys and headers). It is placed in front of the
+// databases with Querier, Writer and Purger sharing the same cache.
+type MemoryCache struct {
+	maxBytes      int64
+	maxObjectSize int64
+
+	mu    sync.Mutex
+	lru   *list.List // front is the most recently used
+	items map[string]*list.Element
+	// keys of each primary key (the URL before the fragment), to purge the
+	// secondary keys with their URL
+	primaries map[string]map[string]struct{}
+	size      int64
+	// version is incremented on every write and purge, responses read from
+	// the databases are not kept when the key may have changed meanwhile
+	version uint64
+
+	hits          atomic.Int64
+	misses        atomic.Int64
+	evictions     atomic.Int64
+	invalidations atomic.Int64
+}
+
+type memoryEntry struct {
+	key  string
+	resp db.Response // without body
+	body []byte
+	size int64
+}
+
+// NewMemoryCache returns an empty memory cache of maxBytes.
+func NewMemoryCache(maxBytes int64) (*MemoryCache, error) {
+	if maxBytes <= 0 {
+		return nil, fmt.Errorf("memory cache size must be positive, got %d", maxBytes)
+	}
+	return &MemoryCache{
+		maxBytes:      maxBytes,
+		maxObjectSize: maxBytes / memoryObjectRatio,
+		lru:           list.New(),
+		items:         make(map[string]*list.Element),
+		primaries:     make(map[string]map[string]struct{}),
+		version:       1,
+	}, nil
+}
+
+func (c *MemoryCache) get(key string) (*db.Response, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	elem, ok := c.items[key]
+	if !ok {
+		return nil, false
+	}
+	c.lru.MoveToFront(elem)
+	entry := elem.Value.(*memoryEntry)
+	resp := entry.resp
+	// the handlers change the headers of the responses found
+	resp.Header = http.Header(entry.resp.Header).Clone()
+	resp.Body = io.NopCloser(bytes.NewReader(entry.body))
+	return &resp, true
+}
+
+// set keeps the response read from the databases at version, unless the key
+// may have changed since then. A zero version is a write, always kept.
+func (c *MemoryCache) set(key string, resp *db.Response, body []byte, version uint64) {
+	entry := &memoryEntry{
+		key:  key,
+		resp: *resp,
+		body: body,
+		size: entrySize(key, resp.Header, body),
+	}
+	entry.resp.Body = nil
+	entry.resp.Header = http.Header(resp.Header).Clone()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if version == 0 {
+		c.version++
+	} else if version != c.version {
+		return
+	}
+	c.remove(key)
+	if entry.size > c.maxObjectSize {
+		return
+	}
+	c.items[key] = c.lru.PushFront(entry)
+	primary, _, _ := strings.Cut(key, "#")
+	keys, ok := c.primaries[primary]
+	if !ok {
+		keys = make(map[string]struct{})
+		c.primaries[primary] = keys
+	}
+	keys[key] = struct{}{}
+	c.size += entry.size
+	for c.size > c.maxBytes {
+		oldest := c.lru.Back().Value.(*memoryEntry)
+		c.remove(oldest.key)
+		c.evictions.Add(1)
+	}
+}
+
+// remove deletes the key, the caller must hold the lock
+func (c *MemoryCache) remove(key string) {
+	elem, ok := c.items[key]
+	if !ok {
+		return
+	}
+	entry := c.lru.Remove(elem).(*memoryEntry)
+	delete(c.items, key)
+	primary, _, _ := strings.Cut(key, "#")
+	if keys := c.primaries[primary]; keys != nil {
+		delete(keys, key)
+		if len(keys) == 0 {
+			delete(c.primaries, primary)
+		}
+	}
+	c.size -= entry.size
+}
+
+// invalidate deletes the key, and the secondary keys of the URL when all is
+// set. The key itself may be a secondary key (POST bodies or --key-header).
+func (c *MemoryCache) invalidate(key string, all bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.version++
+	if _, ok := c.items[key]; ok {
+		c.invalidations.Add(1)
+		c.remove(key)
+	}
+	if !all {
+		return
+	}
+	for k := range c.primaries[key] {
+		c.invalidations.Add(1)
+		c.remove(k)
+	}
+}
+
+// Invalidate removes the URL and its secondary keys from memory, after they
+// are deleted from the databases by another component (the Evictor).
+func (c *MemoryCache) Invalidate(url string) {
+	c.invalidate(url, true)
+}
+
+func (c *MemoryCache) currentVersion() uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.version
+}
+
+func entrySize(key string, header map[string][]string, body []byte) int64 {
+	size := len(key) + len(body)
+	for name, values := range header {
+		size += len(name)
+		for _, value := range values {
+			size += len(value)
+		}
+	}
+	return int64(size)
+}
+
+// readLimited reads the body when it has at most limit bytes. Otherwise the
+// returned reader streams the whole body.
+func readLimited(body io.ReadCloser, limit int64) ([]byte, io.ReadCloser, error) {
+	data, err := io.ReadAll(io.LimitReader(body, limit+1))
+	if err != nil {
+		body.Close()
+		return nil, nil, fmt.Errorf("reading body: %w", err)
+	}
+	if int64(len(data)) > limit {
+		return nil, readCloser{io.MultiReader(bytes.NewReader(data), body), body}, nil
+	}
+	body.Close()
+	return data, io.NopCloser(bytes.NewReader(data)), nil
+}
+
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
+
+// Var returns the memory cache metrics (hits, misses, entries, bytes,
+// evictions and invalidations) to be published with expvar.
+func (c *MemoryCache) Var() expvar.Var {
+	return expvar.Func(func() any {
+		c.mu.Lock()
+		entries, size := int64(len(c.items)), c.size
+		c.mu.Unlock()
+		return map[string]int64{
+			"hits":          c.hits.Load(),
+			"misses":        c.misses.Load(),
+			"entries":       entries,
+			"bytes":         size,
+			"evictions":     c.evictions.Load(),
+			"invalidations": c.invalidations.Load(),
+		}
+	})
+}
+
+type memoryQuerier struct {
+	cache *MemoryCache
+	next  ResponseQuerier
+}
+
+// Querier returns a querier serving the responses kept in memory, and
+// keeping in memory the responses found by next.
+func (c *MemoryCache) Querier(next ResponseQuerier) ResponseQuerier {
+	return &memoryQuerier{
+		cache: c,
+		next:  next,
+	}
+}
+
+func (q *memoryQuerier) FindByURL(ctx context.Context, url string) (*db.Response, error) {
+	if resp, ok := q.cache.get(url); ok {
+		q.cache.hits.Add(1)
+		return resp, nil
+	}
+	q.cache.misses.Add(1)
+	version := q.cache.currentVersion()
+	resp, err := q.next.FindByURL(ctx, url)
+	if err != nil {
+		return nil, err
+	}
+	body, reader, err := readLimited(resp.Body, q.cache.maxObjectSize)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body = reader
+	if body != nil {
+		q.cache.set(url, resp, body, version)
+	}
+	return resp, nil
+}
+
+type memoryWriter struct {
+	cache *MemoryCache
+	next  ResponseWriter
+}
+
+// Writer returns a writer keeping in memory the responses written by next
+// (write-through), with the database and table used by next (TableWriter and
+// DedupRepository set them on the responses written). Responses failing to
+// be written are removed from memory.
+func (c *MemoryCache) Writer(next ResponseWriter) ResponseWriter {
+	return &memoryWriter{
+		cache: c,
+		next:  next,
+	}
+}
+
+func (w *memoryWriter) Write(ctx context.Context, url string, resp *db.Response) error {
+	_, err := w.WriteBatch(ctx, []Entry{{URL: url, Response: resp}})
+	return err
+}
+
+func (w *memoryWriter) WriteBatch(ctx context.Context, entries []Entry) (int, error) {
+	bodies := make([][]byte, 0, len(entries))
+	read := make([]Entry, 0, len(entries))
+	var errs error
+	for _, entry := range entries {
+		body, reader, err := readLimited(entry.Response.Body, w.cache.maxObjectSize)
+		if err != nil {
+			w.cache.invalidate(entry.URL, false)
+			errs = errors.Join(errs, err)
+			continue
+		}
+		entry.Response.Body = reader
+		bodies = append(bodies, body)
+		read = append(read, entry)
+	}
+	n, err := writeEntries(ctx, w.next, read)
+	for i, entry := range read {
+		if err != nil || bodies[i] == nil {
+			// not written or too large to be kept in memory
+			w.cache.invalidate(entry.URL, false)
+			continue
+		}
+		w.cache.set(entry.URL, entry.Response, bodies[i], 0)
+	}
+	return n, errors.Join(errs, err)
+}
+
+// ResponsePurger deletes stored responses
+type ResponsePurger interface {
+	Purge(ctx context.Context, url string) error
+}
+
+type memoryPurger struct {
+	cache *MemoryCache
+	next  ResponsePurger
+}
+
+// Purger returns a purger removing the URL and its secondary keys from
+// memory before purging them with next.
+func (c *MemoryCache) Purger(next ResponsePurger) ResponsePurger {
+	return &memoryPurger{
+		cache: c,
+		next:  next,
+	}
+}
+
+func (p *memoryPurger) Purge(ctx context.Context, url string) error {
+	p.cache.invalidate(url, true)
+	return p.next.Purge(ctx, url)
+}
@@ -0,0 +1,282 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/litesql/httpcache/db"
+)
+
+// countingQuerier counts the lookups and finds every URL with the same body
+type countingQuerier struct {
+	calls int
+	body  string
+	// before runs on each lookup, before the response is returned
+	before func()
+}
+
+func (q *countingQuerier) FindByURL(ctx context.Context, url string) (*db.Response, error) {
+	q.calls++
+	if q.before != nil {
+		q.before()
+	}
+	if q.body == "" {
+		return nil, sql.ErrNoRows
+	}
+	return &db.Response{
+		Status:    200,
+		Header:    map[string][]string{"Content-Type": {"text/plain"}},
+		Body:      io.NopCloser(strings.NewReader(q.body)),
+		TableName: "http_response",
+	}, nil
+}
+
+type discardWriter struct{}
+
+func (discardWriter) Write(ctx context.Context, url string, resp *db.Response) error {
+	_, err := io.Copy(io.Discard, resp.Body)
+	return errors.Join(err, resp.Body.Close())
+}
+
+type failingWriter struct{}
+
+func (failingWriter) Write(ctx context.Context, url string, resp *db.Response) error {
+	resp.Body.Close()
+	return errors.New("database is broken")
+}
+
+type discardPurger struct{}
+
+func (discardPurger) Purge(ctx context.Context, url string) error {
+	return nil
+}
+
+func newTestMemoryCache(t *testing.T, maxBytes int64) *MemoryCache {
+	t.Helper()
+	cache, err := NewMemoryCache(maxBytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cache
+}
+
+func TestNewMemoryCacheInvalidSize(t *testing.T) {
+	if _, err := NewMemoryCache(0); err == nil {
+		t.Error("empty memory cache accepted")
+	}
+}
+
+func TestMemoryQuerier(t *testing.T) {
+	ctx := context.Background()
+	cache := newTestMemoryCache(t, 8000)
+	next := &countingQuerier{body: "hello"}
+	querier := cache.Querier(next)
+	for range 3 {
+		resp, err := querier.FindByURL(ctx, "http://x/1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if body := readBody(t, resp); body != "hello" || resp.Header["Content-Type"][0] != "text/plain" {
+			t.Fatalf("got body %q and header %v", body, resp.Header)
+		}
+		// the handlers change the headers of the responses found
+		resp.Header["Content-Type"] = nil
+	}
+	if next.calls != 1 {
+		t.Errorf("got %d database lookups, want 1", next.calls)
+	}
+
+	next.body = ""
+	for range 2 {
+		if _, err := querier.FindByURL(ctx, "http://x/missing"); !errors.Is(err, sql.ErrNoRows) {
+			t.Fatalf("got %v, want sql.ErrNoRows", err)
+		}
+	}
+	if next.calls != 3 {
+		t.Errorf("got %d database lookups, want missing responses looked up again", next.calls)
+	}
+
+	var metrics map[string]int64
+	if err := json.Unmarshal([]byte(cache.Var().String()), &metrics); err != nil {
+		t.Fatal(err)
+	}
+	if metrics["hits"] != 2 || metrics["misses"] != 3 || metrics["entries"] != 1 {
+		t.Errorf("got metrics %v", metrics)
+	}
+}
+
+func TestMemoryQuerierSize(t *testing.T) {
+	ctx := context.Background()
+	cache := newTestMemoryCache(t, 8000)
+	next := &countingQuerier{body: strings.Repeat("z", 900)}
+	querier := cache.Querier(next)
+	for i := range 50 {
+		if _, err := querier.FindByURL(ctx, fmt.Sprintf("http://x/%d", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if cache.size > cache.maxBytes {
+		t.Errorf("got %d bytes in memory, want at most %d", cache.size, cache.maxBytes)
+	}
+	if _, ok := cache.get("http://x/0"); ok {
+		t.Error("least recently used response kept")
+	}
+	if _, ok := cache.get("http://x/49"); !ok {
+		t.Error("most recently used response evicted")
+	}
+
+	// responses larger than the object limit are streamed and not kept
+	next.body = strings.Repeat("z", 2000)
+	resp, err := querier.FindByURL(ctx, "http://x/large")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if body := readBody(t, resp); len(body) != 2000 {
+		t.Errorf("got %d bytes, want 2000", len(body))
+	}
+	if _, ok := cache.get("http://x/large"); ok {
+		t.Error("large response kept in memory")
+	}
+}
+
+func TestMemoryWriter(t *testing.T) {
+	ctx := context.Background()
+	cache := newTestMemoryCache(t, 8000)
+	next := &countingQuerier{body: "old"}
+	querier := cache.Querier(next)
+	if _, err := querier.FindByURL(ctx, "http://x/1"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := cache.Writer(discardWriter{}).Write(ctx, "http://x/1", newTestResponse("new", time.Now())); err != nil {
+		t.Fatal(err)
+	}
+	resp, err := querier.FindByURL(ctx, "http://x/1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if body := readBody(t, resp); body != "new" || next.calls != 1 {
+		t.Errorf("got %q after %d lookups, want the written response from memory", body, next.calls)
+	}
+
+	// a response failing to be written is removed
+	if err := cache.Writer(failingWriter{}).Write(ctx, "http://x/1", newTestResponse("failed", time.Now())); err == nil {
+		t.Fatal("write error not returned")
+	}
+	if _, ok := cache.get("http://x/1"); ok {
+		t.Error("response failing to be written kept in memory")
+	}
+}
+
+func TestMemoryWriterLocation(t *testing.T) {
+	ctx := context.Background()
+	dbs, _ := openTestRepositories(t, 2)
+	tw, err := NewTableWriter(dbs, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tw.Close()
+	cache := newTestMemoryCache(t, 8000)
+	if err := cache.Writer(tw).Write(ctx, "http://x/1", newTestResponse("fresh", time.Now())); err != nil {
+		t.Fatal(err)
+	}
+	resp, ok := cache.get("http://x/1")
+	if !ok {
+		t.Fatal("written response not kept in memory")
+	}
+	if resp.DatabaseID < 0 || resp.TableName != "http_response" {
+		t.Fatalf("kept with database %d and table %q", resp.DatabaseID, resp.TableName)
+	}
+	if n := countRows(t, dbs[resp.DatabaseID], resp.TableName, "url = 'http://x/1'"); n != 1 {
+		t.Error("kept with a database not storing the response")
+	}
+}
+
+func TestMemoryPurger(t *testing.T) {
+	ctx := context.Background()
+	cache := newTestMemoryCache(t, 8000)
+	querier := cache.Querier(&countingQuerier{body: "hello"})
+	purger := cache.Purger(discardPurger{})
+	for _, url := range []string{"http://x/1", "http://x/1#vary:accept=json", "http://x/2#body:abc", "http://x/2"} {
+		if _, err := querier.FindByURL(ctx, url); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := purger.Purge(ctx, "http://x/1"); err != nil {
+		t.Fatal(err)
+	}
+	for _, url := range []string{"http://x/1", "http://x/1#vary:accept=json"} {
+		if _, ok := cache.get(url); ok {
+			t.Errorf("%s kept after purging its URL", url)
+		}
+	}
+
+	// an exact secondary key is purged without the other keys of its URL
+	if err := purger.Purge(ctx, "http://x/2#body:abc"); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := cache.get("http://x/2#body:abc"); ok {
+		t.Error("secondary key kept after purge")
+	}
+	if _, ok := cache.get("http://x/2"); !ok {
+		t.Error("URL removed when purging a secondary key")
+	}
+}
+
+func TestMemoryQuerierRace(t *testing.T) {
+	ctx := context.Background()
+	cache := newTestMemoryCache(t, 8000)
+	next := &countingQuerier{body: "old"}
+	// the response is written while the old one is read from the database
+	next.before = func() {
+		if err := cache.Writer(discardWriter{}).Write(ctx, "http://x/1", newTestResponse("new", time.Now())); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := cache.Querier(next).FindByURL(ctx, "http://x/1"); err != nil {
+		t.Fatal(err)
+	}
+	resp, ok := cache.get("http://x/1")
+	if !ok {
+		t.Fatal("written response not kept")
+	}
+	if body := readBody(t, resp); body != "new" {
+		t.Errorf("got %q, want the written response", body)
+	}
+}
+
+func TestMemoryEviction(t *testing.T) {
+	ctx := context.Background()
+	sqlDB := openTestDB(t)
+	repo, err := db.NewRepository(sqlDB, 0, 0, "http_response")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cache := newTestMemoryCache(t, 1<<20)
+	evictor := newTestEvictor(t, []*sql.DB{sqlDB}, EvictionConfig{MaxRows: 1, Policy: Oldest, Invalidator: cache})
+	querier := cache.Querier(repo)
+	base := time.Now().Add(-time.Hour)
+	for i, url := range []string{"http://x/old", "http://x/new"} {
+		if err := repo.Write(ctx, url, newTestResponse(url, base.Add(time.Duration(i)*time.Minute))); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := querier.FindByURL(ctx, url); err != nil {
+			t.Fatal(err)
+		}
+	}
+	evictor.run(ctx)
+	if _, ok := cache.get("http://x/old"); ok {
+		t.Error("evicted response kept in memory")
+	}
+	if _, ok := cache.get("http://x/new"); !ok {
+		t.Error("response not evicted removed from memory")
+	}
+}
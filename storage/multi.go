@@ -0,0 +1,162 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"sync/atomic"
+
+	"github.com/litesql/httpcache/db"
+)
+
+// ReadStrategy chooses how a response is looked up in several databases
+type ReadStrategy string
+
+const (
+	Race       ReadStrategy = "race"        // query all the databases, the first response found wins
+	Ordered    ReadStrategy = "ordered"     // query the databases in order until the response is found
+	Newest     ReadStrategy = "newest"      // query all the databases, the most recent response wins
+	RoundRobin ReadStrategy = "round-robin" // like ordered, starting from the next database on each lookup
+)
+
+// MultiQuerier looks up the responses in several databases following the
+// read strategy. Databases failing to answer are skipped.
+type MultiQuerier struct {
+	strategy ReadStrategy
+	dbs      []ResponseQuerier
+	current  atomic.Uint64
+}
+
+// NewMultiQuerier returns a querier over the queriers of each database.
+// The responses found get the index of their database as DatabaseID.
+func NewMultiQuerier(strategy ReadStrategy, dbs []ResponseQuerier) (*MultiQuerier, error) {
+	switch strategy {
+	case Race, Ordered, Newest, RoundRobin:
+	default:
+		return nil, fmt.Errorf("invalid read strategy %q", strategy)
+	}
+	return &MultiQuerier{
+		strategy: strategy,
+		dbs:      dbs,
+	}, nil
+}
+
+func (q *MultiQuerier) FindByURL(ctx context.Context, url string) (*db.Response, error) {
+	switch q.strategy {
+	case Ordered:
+		return q.sequential(ctx, url, 0)
+	case RoundRobin:
+		start := (q.current.Add(1) - 1) % uint64(len(q.dbs))
+		return q.sequential(ctx, url, int(start))
+	case Newest:
+		return q.newest(ctx, url)
+	default:
+		return q.race(ctx, url)
+	}
+}
+
+func (q *MultiQuerier) sequential(ctx context.Context, url string, start int) (*db.Response, error) {
+	var lastErr error
+	for i := range q.dbs {
+		databaseID := (start + i) % len(q.dbs)
+		resp, err := q.dbs[databaseID].FindByURL(ctx, url)
+		if err != nil {
+			if !errors.Is(err, sql.ErrNoRows) {
+				lastErr = err
+			}
+			continue
+		}
+		resp.DatabaseID = databaseID
+		return resp, nil
+	}
+	return nil, notFound(lastErr)
+}
+
+type lookupResult struct {
+	resp *db.Response
+	err  error
+}
+
+// queryAll queries every database concurrently, the results are sent in
+// the order they arrive.
+func (q *MultiQuerier) queryAll(ctx context.Context, url string) <-chan lookupResult {
+	results := make(chan lookupResult, len(q.dbs))
+	for databaseID, querier := range q.dbs {
+		go func() {
+			resp, err := querier.FindByURL(ctx, url)
+			if err == nil {
+				resp.DatabaseID = databaseID
+			}
+			results <- lookupResult{resp: resp, err: err}
+		}()
+	}
+	return results
+}
+
+func (q *MultiQuerier) race(ctx context.Context, url string) (*db.Response, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	results := q.queryAll(ctx, url)
+	var lastErr error
+	for i := range q.dbs {
+		result := <-results
+		if result.err != nil {
+			if !errors.Is(result.err, sql.ErrNoRows) && !errors.Is(result.err, context.Canceled) {
+				lastErr = result.err
+			}
+			continue
+		}
+		cancel()
+		// release the responses of the slower databases
+		go discard(results, len(q.dbs)-i-1)
+		return result.resp, nil
+	}
+	cancel()
+	return nil, notFound(lastErr)
+}
+
+func (q *MultiQuerier) newest(ctx context.Context, url string) (*db.Response, error) {
+	results := q.queryAll(ctx, url)
+	var (
+		newest  *db.Response
+		lastErr error
+	)
+	for range q.dbs {
+		result := <-results
+		if result.err != nil {
+			if !errors.Is(result.err, sql.ErrNoRows) {
+				lastErr = result.err
+			}
+			continue
+		}
+		if newest == nil || result.resp.ResponseTime.After(newest.ResponseTime) {
+			if newest != nil {
+				newest.Body.Close()
+			}
+			newest = result.resp
+			continue
+		}
+		result.resp.Body.Close()
+	}
+	if newest == nil {
+		return nil, notFound(lastErr)
+	}
+	return newest, nil
+}
+
+func discard(results <-chan lookupResult, n int) {
+	for range n {
+		if result := <-results; result.err == nil {
+			result.resp.Body.Close()
+		}
+	}
+}
+
+// notFound returns sql.ErrNoRows, or the error of a database failing to
+// answer when the response may be stored there
+func notFound(err error) error {
+	if err != nil {
+		return err
+	}
+	return sql.ErrNoRows
+}
@@ -0,0 +1,59 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+
+	"github.com/litesql/httpcache/db"
+)
+
+// Purger deletes stored responses from every response table of the databases.
+type Purger struct {
+	stmts []*sql.Stmt
+}
+
+// NewPurger prepares the delete statements for the response tables discovered on each database.
+func NewPurger(dbs []*sql.DB) (*Purger, error) {
+	stmts := make([]*sql.Stmt, 0)
+	for i, sqlDB := range dbs {
+		tables, err := db.ResponseTables(sqlDB)
+		if err != nil {
+			return nil, fmt.Errorf("discovery response tables on database %d: %w", i, err)
+		}
+		for _, tableName := range tables {
+			stmt, err := sqlDB.Prepare(purgeQuery(tableName))
+			if err != nil {
+				return nil, fmt.Errorf("prepare purge query for %q: %w", tableName, err)
+			}
+			stmts = append(stmts, stmt)
+		}
+	}
+	return &Purger{
+		stmts: stmts,
+	}, nil
+}
+
+// Purge deletes the entries stored for the URL, including the secondary
+// keys (the URL followed by a fragment) used to store Vary variants.
+func (p *Purger) Purge(ctx context.Context, url string) error {
+	var err error
+	for _, stmt := range p.stmts {
+		_, execErr := stmt.ExecContext(ctx, url)
+		err = errors.Join(err, execErr)
+	}
+	return err
+}
+
+func (p *Purger) Close() error {
+	var err error
+	for _, stmt := range p.stmts {
+		err = errors.Join(err, stmt.Close())
+	}
+	return err
+}
+
+func purgeQuery(tableName string) string {
+	return fmt.Sprintf("DELETE FROM %s WHERE url = ?1 OR (url >= ?1 || '#' AND url < ?1 || '$')", tableName)
+}
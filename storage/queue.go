@@ -0,0 +1,171 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"expvar"
+	"log/slog"
+	"sync"
+	"sync/atomic"
+
+	"github.com/litesql/httpcache/db"
+)
+
+var (
+	// ErrQueueFull is returned when a response is dropped because the queue is full
+	ErrQueueFull = errors.New("write queue full")
+	// ErrQueueClosed is returned when a response is written after Close
+	ErrQueueClosed = errors.New("write queue closed")
+)
+
+// Entry is a response to be stored with its key
+type Entry struct {
+	URL      string
+	Response *db.Response
+}
+
+// BatchWriter stores several responses at once, in a transaction per
+// database. It returns the number of responses written.
+type BatchWriter interface {
+	WriteBatch(ctx context.Context, entries []Entry) (int, error)
+}
+
+// QueueConfig sets the size of the write queue
+type QueueConfig struct {
+	Depth     int  // pending responses, defaults to 1000
+	Workers   int  // goroutines writing the responses, defaults to 1
+	BatchSize int  // maximum responses per batch, defaults to 100
+	Block     bool // wait for room when the queue is full instead of dropping the response
+}
+
+// WriteQueue writes the responses in background with a fixed number of
+// workers. Pending responses are grouped in batches written by the next
+// writer in a single call when it is a BatchWriter.
+type WriteQueue struct {
+	next      ResponseWriter
+	entries   chan Entry
+	batchSize int
+	block     bool
+
+	closed bool
+	mu     sync.RWMutex
+	wg     sync.WaitGroup
+
+	written atomic.Int64
+	failed  atomic.Int64
+	dropped atomic.Int64
+	batches atomic.Int64
+}
+
+// NewWriteQueue starts the workers writing the queued responses with next.
+func NewWriteQueue(next ResponseWriter, config QueueConfig) *WriteQueue {
+	if config.Depth <= 0 {
+		config.Depth = 1000
+	}
+	if config.Workers <= 0 {
+		config.Workers = 1
+	}
+	if config.BatchSize <= 0 {
+		config.BatchSize = 100
+	}
+	q := WriteQueue{
+		next:      next,
+		entries:   make(chan Entry, config.Depth),
+		batchSize: config.BatchSize,
+		block:     config.Block,
+	}
+	q.wg.Add(config.Workers)
+	for range config.Workers {
+		go q.work()
+	}
+	return &q
+}
+
+// Write queues the response. When the queue is full the response is dropped
+// and ErrQueueFull is returned, unless the queue was configured to block.
+func (q *WriteQueue) Write(ctx context.Context, url string, resp *db.Response) error {
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+	if q.closed {
+		resp.Body.Close()
+		return ErrQueueClosed
+	}
+	entry := Entry{URL: url, Response: resp}
+	if q.block {
+		select {
+		case q.entries <- entry:
+			return nil
+		case <-ctx.Done():
+			q.dropped.Add(1)
+			resp.Body.Close()
+			return ctx.Err()
+		}
+	}
+	select {
+	case q.entries <- entry:
+		return nil
+	default:
+		q.dropped.Add(1)
+		resp.Body.Close()
+		return ErrQueueFull
+	}
+}
+
+func (q *WriteQueue) work() {
+	defer q.wg.Done()
+	batch := make([]Entry, 0, q.batchSize)
+	for entry := range q.entries {
+		batch = append(batch[:0], entry)
+	fill:
+		for len(batch) < q.batchSize {
+			select {
+			case entry, ok := <-q.entries:
+				if !ok {
+					break fill
+				}
+				batch = append(batch, entry)
+			default:
+				break fill
+			}
+		}
+		q.write(batch)
+	}
+}
+
+func (q *WriteQueue) write(batch []Entry) {
+	q.batches.Add(1)
+	n, err := writeEntries(context.Background(), q.next, batch)
+	q.written.Add(int64(n))
+	if err != nil {
+		q.failed.Add(int64(len(batch) - n))
+		slog.Error("recording responses", "error", err, "batch", len(batch), "written", n)
+	}
+}
+
+// Var returns the queue metrics (pending, written, failed, dropped and
+// batches) to be published with expvar.
+func (q *WriteQueue) Var() expvar.Var {
+	return expvar.Func(func() any {
+		return map[string]int64{
+			"pending": int64(len(q.entries)),
+			"written": q.written.Load(),
+			"failed":  q.failed.Load(),
+			"dropped": q.dropped.Load(),
+			"batches": q.batches.Load(),
+		}
+	})
+}
+
+// Close stops accepting responses and waits for the pending ones to be written.
+func (q *WriteQueue) Close() error {
+	q.mu.Lock()
+	if q.closed {
+		q.mu.Unlock()
+		return nil
+	}
+	q.closed = true
+	close(q.entries)
+	q.mu.Unlock()
+	q.wg.Wait()
+	return nil
+}
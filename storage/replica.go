@@ -0,0 +1,232 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"slices"
+	"strings"
+
+	"github.com/litesql/httpcache/db"
+)
+
+// ReplicatedWriter writes each response into several databases. The next
+// writer must write into db.Response.DatabaseID.
+type ReplicatedWriter struct {
+	next     ResponseWriter
+	dbs      []*sql.DB
+	replicas int
+	ring     *Ring
+}
+
+// NewReplicatedWriter returns a writer storing each response in replicas of
+// the databases. With a ring, the databases are the first replicas databases
+// of the key on the ring. Otherwise they are the database chosen by a hash of
+// the key and the following ones. The copies stored in other databases (older
+// versions) are deleted by Repair.
+func NewReplicatedWriter(next ResponseWriter, dbs []*sql.DB, replicas int, ring *Ring) (*ReplicatedWriter, error) {
+	if replicas < 1 || replicas > len(dbs) {
+		return nil, fmt.Errorf("replicas must be between 1 and the number of databases (%d), got %d", len(dbs), replicas)
+	}
+	return &ReplicatedWriter{
+		next:     next,
+		dbs:      dbs,
+		replicas: replicas,
+		ring:     ring,
+	}, nil
+}
+
+// placement returns the databases of the key. The secondary keys are placed
+// with their URL.
+func (w *ReplicatedWriter) placement(url string) []int {
+	if w.ring != nil {
+		return w.ring.GetN(url, w.replicas)
+	}
+	primary, _, _ := strings.Cut(url, "#")
+	first := int(hashKey(primary) % uint64(len(w.dbs)))
+	databases := make([]int, w.replicas)
+	for i := range databases {
+		databases[i] = (first + i) % len(w.dbs)
+	}
+	return databases
+}
+
+// outside returns the databases not in the placement
+func (w *ReplicatedWriter) outside(placement []int) []int {
+	databases := make([]int, 0, len(w.dbs)-len(placement))
+	for i := range w.dbs {
+		if !slices.Contains(placement, i) {
+			databases = append(databases, i)
+		}
+	}
+	return databases
+}
+
+func (w *ReplicatedWriter) Write(ctx context.Context, url string, resp *db.Response) error {
+	_, err := w.WriteBatch(ctx, []Entry{{URL: url, Response: resp}})
+	return err
+}
+
+// WriteBatch writes the copies of the responses in a single batch. It
+// returns the number of copies written divided by the replicas.
+func (w *ReplicatedWriter) WriteBatch(ctx context.Context, entries []Entry) (int, error) {
+	copies := make([]Entry, 0, len(entries)*w.replicas)
+	var errs error
+	for _, entry := range entries {
+		body, err := io.ReadAll(entry.Response.Body)
+		entry.Response.Body.Close()
+		if err != nil {
+			errs = errors.Join(errs, fmt.Errorf("reading body: %w", err))
+			continue
+		}
+		for _, databaseID := range w.placement(entry.URL) {
+			replica := *entry.Response
+			replica.DatabaseID = databaseID
+			replica.Body = io.NopCloser(bytes.NewReader(body))
+			copies = append(copies, Entry{URL: entry.URL, Response: &replica})
+		}
+	}
+	n, err := writeEntries(ctx, w.next, copies)
+	return n / w.replicas, errors.Join(errs, err)
+}
+
+// Repair copies the responses stored in fewer databases of their placement
+// than the replicas (after losing a database file, for example) to the
+// missing databases, and deletes the copies stored outside the placement
+// (older versions, or after changing the replicas) once every database of
+// the placement has the response. The responses are read with the queriers of each database, preferably from
+// a database of the placement.
+func (w *ReplicatedWriter) Repair(ctx context.Context, queriers []ResponseQuerier) (int, error) {
+	tables := make([][]string, len(w.dbs))
+	for i, sqlDB := range w.dbs {
+		var err error
+		if tables[i], err = db.ResponseTables(sqlDB); err != nil {
+			// a missing or broken database is repaired when it is back
+			slog.Warn("repair: skipping database", "error", err, "database", i)
+		}
+	}
+	var copied int
+	for i, sqlDB := range w.dbs {
+		for _, tableName := range tables[i] {
+			urls, err := listKeys(ctx, sqlDB, tableName)
+			if err != nil {
+				return copied, err
+			}
+			for _, url := range urls {
+				present := make([]bool, len(w.dbs))
+				for j := range w.dbs {
+					present[j] = j == i || stored(ctx, w.dbs[j], tables[j], url)
+				}
+				placement := w.placement(url)
+				if source(placement, present) != i {
+					// repaired from another database
+					continue
+				}
+				missing := make([]int, 0)
+				for _, databaseID := range placement {
+					if !present[databaseID] {
+						missing = append(missing, databaseID)
+					}
+				}
+				if len(missing) > 0 {
+					n, err := w.copy(ctx, queriers[i], tableName, url, missing)
+					copied += n
+					if err != nil {
+						slog.Error("repair", "error", err, "url", url, "database", i)
+					}
+					if n < len(missing) {
+						continue
+					}
+				}
+				outside := slices.DeleteFunc(w.outside(placement), func(databaseID int) bool {
+					return !present[databaseID]
+				})
+				if err := remove(ctx, w.dbs, tables, url, outside); err != nil {
+					slog.Error("repair", "error", err, "url", url)
+				}
+			}
+		}
+	}
+	return copied, nil
+}
+
+// source returns the database the response is repaired from: the first
+// database of the placement having it, or the first database having it when
+// it is stored only outside its placement.
+func source(placement []int, present []bool) int {
+	for _, databaseID := range placement {
+		if present[databaseID] {
+			return databaseID
+		}
+	}
+	return slices.Index(present, true)
+}
+
+func (w *ReplicatedWriter) copy(ctx context.Context, querier ResponseQuerier, tableName, url string, databases []int) (int, error) {
+	resp, err := querier.FindByURL(ctx, url)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return 0, fmt.Errorf("reading body: %w", err)
+	}
+	copies := make([]Entry, len(databases))
+	for i, databaseID := range databases {
+		replica := *resp
+		replica.DatabaseID = databaseID
+		replica.TableName = tableName
+		replica.Body = io.NopCloser(bytes.NewReader(body))
+		copies[i] = Entry{URL: url, Response: &replica}
+	}
+	return writeEntries(ctx, w.next, copies)
+}
+
+func listKeys(ctx context.Context, sqlDB *sql.DB, tableName string) ([]string, error) {
+	rows, err := sqlDB.QueryContext(ctx, "SELECT url FROM "+tableName)
+	if err != nil {
+		return nil, fmt.Errorf("list keys of %q: %w", tableName, err)
+	}
+	defer rows.Close()
+	urls := make([]string, 0)
+	for rows.Next() {
+		var url string
+		if err := rows.Scan(&url); err != nil {
+			return nil, fmt.Errorf("scan key: %w", err)
+		}
+		urls = append(urls, url)
+	}
+	return urls, rows.Err()
+}
+
+// remove deletes the key from every response table of the databases
+func remove(ctx context.Context, dbs []*sql.DB, tables [][]string, url string, databases []int) error {
+	var errs error
+	for _, databaseID := range databases {
+		for _, tableName := range tables[databaseID] {
+			_, err := dbs[databaseID].ExecContext(ctx, "DELETE FROM "+tableName+" WHERE url = ?", url)
+			errs = errors.Join(errs, err)
+		}
+	}
+	return errs
+}
+
+// stored reports whether a response table of the database has the key
+func stored(ctx context.Context, sqlDB *sql.DB, tables []string, url string) bool {
+	for _, tableName := range tables {
+		var found bool
+		err := sqlDB.QueryRowContext(ctx, "SELECT EXISTS(SELECT 1 FROM "+tableName+" WHERE url = ?)", url).Scan(&found)
+		if err == nil && found {
+			return true
+		}
+	}
+	return false
+}
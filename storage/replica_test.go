@@ -0,0 +1,240 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/litesql/httpcache/db"
+)
+
+// brokenDatabaseWriter fails the writes into one database
+type brokenDatabaseWriter struct {
+	next       ResponseWriter
+	databaseID int
+}
+
+func (w brokenDatabaseWriter) Write(ctx context.Context, url string, resp *db.Response) error {
+	if resp.DatabaseID == w.databaseID {
+		resp.Body.Close()
+		return errors.New("database is broken")
+	}
+	return w.next.Write(ctx, url, resp)
+}
+
+func newTestReplicatedWriter(t *testing.T, dbs []*sql.DB, ring *Ring) *ReplicatedWriter {
+	t.Helper()
+	tw, err := NewTableWriter(dbs, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { tw.Close() })
+	writer, err := NewReplicatedWriter(tw, dbs, 2, ring)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return writer
+}
+
+// insertRow stores a response directly in the database
+func insertRow(t *testing.T, sqlDB *sql.DB, url, body string) {
+	t.Helper()
+	_, err := sqlDB.Exec("INSERT INTO http_response(url, status, body, header, request_time, response_time) VALUES (?, 200, ?, '{}', '2020-01-01T00:00:00Z', '2020-01-01T00:00:00Z')", url, body)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func storedBody(t *testing.T, sqlDB *sql.DB, url string) string {
+	t.Helper()
+	var body string
+	err := sqlDB.QueryRow("SELECT body FROM http_response WHERE url = ?", url).Scan(&body)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		t.Fatal(err)
+	}
+	return body
+}
+
+func totalRows(t *testing.T, dbs []*sql.DB) int {
+	t.Helper()
+	total := 0
+	for _, sqlDB := range dbs {
+		total += countRows(t, sqlDB, "http_response", "")
+	}
+	return total
+}
+
+func TestNewReplicatedWriter(t *testing.T) {
+	dbs := make([]*sql.DB, 3)
+	for _, replicas := range []int{0, 4} {
+		if _, err := NewReplicatedWriter(nil, dbs, replicas, nil); err == nil {
+			t.Errorf("%d replicas of 3 databases accepted", replicas)
+		}
+	}
+}
+
+func TestReplicatedWriter(t *testing.T) {
+	for _, ring := range []*Ring{nil, NewRing([]string{"a.db", "b.db", "c.db", "d.db"})} {
+		t.Run(fmt.Sprintf("ring=%t", ring != nil), func(t *testing.T) {
+			ctx := context.Background()
+			dbs, _ := openTestRepositories(t, 4)
+			writer := newTestReplicatedWriter(t, dbs, ring)
+
+			entries := make([]Entry, 0, 100)
+			for i := range 100 {
+				url := fmt.Sprintf("http://x/%d", i)
+				entries = append(entries, Entry{URL: url, Response: newTestResponse(url, time.Now())})
+			}
+			n, err := writer.WriteBatch(ctx, entries)
+			if err != nil || n != 100 {
+				t.Fatalf("got %d written, %v", n, err)
+			}
+			if total := totalRows(t, dbs); total != 200 {
+				t.Errorf("got %d copies, want 200", total)
+			}
+			for _, entry := range entries {
+				placement := writer.placement(entry.URL)
+				if len(placement) != 2 || placement[0] == placement[1] {
+					t.Fatalf("%s placed in %v, want 2 databases", entry.URL, placement)
+				}
+				for _, databaseID := range placement {
+					if body := storedBody(t, dbs[databaseID], entry.URL); body != entry.URL {
+						t.Errorf("%s: got %q in database %d", entry.URL, body, databaseID)
+					}
+				}
+				if got := writer.placement(entry.URL + "#vary:accept=json"); fmt.Sprint(got) != fmt.Sprint(placement) {
+					t.Errorf("secondary key of %s placed in %v, want %v", entry.URL, got, placement)
+				}
+			}
+		})
+	}
+}
+
+func TestReplicatedWriterKeepsOutsideCopies(t *testing.T) {
+	ctx := context.Background()
+	dbs, _ := openTestRepositories(t, 3)
+	writer := newTestReplicatedWriter(t, dbs, nil)
+	url := "http://x/1"
+	outside := writer.outside(writer.placement(url))[0]
+	insertRow(t, dbs[outside], url, "old")
+
+	resp := newTestResponse("new", time.Now())
+	// the database of the response found by the proxy is ignored
+	resp.DatabaseID = outside
+	if err := writer.Write(ctx, url, resp); err != nil {
+		t.Fatal(err)
+	}
+	for _, databaseID := range writer.placement(url) {
+		if body := storedBody(t, dbs[databaseID], url); body != "new" {
+			t.Errorf("got %q in database %d, want new", body, databaseID)
+		}
+	}
+	if body := storedBody(t, dbs[outside], url); body != "old" {
+		t.Errorf("got %q outside the placement, want the old copy left to Repair", body)
+	}
+}
+
+func TestReplicatedWriterRepair(t *testing.T) {
+	for _, ring := range []*Ring{nil, NewRing([]string{"a.db", "b.db", "c.db", "d.db"})} {
+		t.Run(fmt.Sprintf("ring=%t", ring != nil), func(t *testing.T) {
+			ctx := context.Background()
+			dbs, queriers := openTestRepositories(t, 4)
+			writer := newTestReplicatedWriter(t, dbs, ring)
+			for i := range 100 {
+				url := fmt.Sprintf("http://x/%d", i)
+				if err := writer.Write(ctx, url, newTestResponse(url, time.Now())); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			// a lost database
+			lost := countRows(t, dbs[1], "http_response", "")
+			if _, err := dbs[1].Exec("DELETE FROM http_response"); err != nil {
+				t.Fatal(err)
+			}
+			copied, err := writer.Repair(ctx, queriers)
+			if err != nil || copied != lost {
+				t.Fatalf("got %d copied, %v, want %d", copied, err, lost)
+			}
+			if total := totalRows(t, dbs); total != 200 {
+				t.Errorf("got %d copies after repair, want 200", total)
+			}
+			if copied, _ := writer.Repair(ctx, queriers); copied != 0 {
+				t.Errorf("got %d copied by the second repair, want 0", copied)
+			}
+
+			// an old copy outside the placement is deleted and never used as source
+			url := "http://x/7"
+			placement := writer.placement(url)
+			outside := writer.outside(placement)[0]
+			insertRow(t, dbs[outside], url, "old")
+			if _, err := dbs[placement[1]].Exec("DELETE FROM http_response WHERE url = ?", url); err != nil {
+				t.Fatal(err)
+			}
+			if copied, err := writer.Repair(ctx, queriers); err != nil || copied != 1 {
+				t.Fatalf("got %d copied, %v, want 1", copied, err)
+			}
+			if body := storedBody(t, dbs[placement[1]], url); body != url {
+				t.Errorf("repaired %q, want the copy of the placement", body)
+			}
+			if n := countRows(t, dbs[outside], "http_response", "url = ?", url); n != 0 {
+				t.Error("copy outside the placement not deleted")
+			}
+
+			// a response stored only outside its placement is moved
+			url = "http://x/8"
+			placement = writer.placement(url)
+			outside = writer.outside(placement)[0]
+			for _, databaseID := range placement {
+				if _, err := dbs[databaseID].Exec("DELETE FROM http_response WHERE url = ?", url); err != nil {
+					t.Fatal(err)
+				}
+			}
+			insertRow(t, dbs[outside], url, "moved")
+			if copied, err := writer.Repair(ctx, queriers); err != nil || copied != 2 {
+				t.Fatalf("got %d copied, %v, want 2", copied, err)
+			}
+			for _, databaseID := range placement {
+				if body := storedBody(t, dbs[databaseID], url); body != "moved" {
+					t.Errorf("got %q in database %d, want moved", body, databaseID)
+				}
+			}
+			if total := totalRows(t, dbs); total != 200 {
+				t.Errorf("got %d copies, want 200", total)
+			}
+		})
+	}
+}
+
+func TestReplicatedWriterRepairFailure(t *testing.T) {
+	ctx := context.Background()
+	dbs, queriers := openTestRepositories(t, 3)
+	tw, err := NewTableWriter(dbs, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tw.Close()
+	url := "http://x/1"
+	probe, err := NewReplicatedWriter(tw, dbs, 2, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	placement := probe.placement(url)
+	outside := probe.outside(placement)[0]
+	insertRow(t, dbs[placement[0]], url, "v1")
+	insertRow(t, dbs[outside], url, "v1")
+
+	writer, err := NewReplicatedWriter(brokenDatabaseWriter{next: tw, databaseID: placement[1]}, dbs, 2, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if copied, _ := writer.Repair(ctx, queriers); copied != 0 {
+		t.Errorf("got %d copied into the broken database, want 0", copied)
+	}
+	if n := countRows(t, dbs[outside], "http_response", "url = ?", url); n != 1 {
+		t.Error("copy outside the placement deleted before the placement was complete")
+	}
+}
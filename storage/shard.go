@@ -0,0 +1,213 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"log/slog"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/litesql/httpcache/db"
+)
+
+// ringReplicas is the number of points of each database on the ring
+const ringReplicas = 160
+
+// Ring maps the cache keys to databases by consistent hashing. Adding a
+// database moves only the keys taken by its points on the ring.
+type Ring struct {
+	points []uint64
+	owners []int
+}
+
+// NewRing builds the ring of the databases identified by name (usually the
+// database path). Names must be stable across restarts, the position of
+// each database on the ring depends only on its name.
+func NewRing(names []string) *Ring {
+	type point struct {
+		hash  uint64
+		owner int
+	}
+	points := make([]point, 0, len(names)*ringReplicas)
+	for i, name := range names {
+		for replica := range ringReplicas {
+			points = append(points, point{hash: hashKey(name + "#" + strconv.Itoa(replica)), owner: i})
+		}
+	}
+	sort.Slice(points, func(i, j int) bool {
+		return points[i].hash < points[j].hash
+	})
+	ring := Ring{
+		points: make([]uint64, len(points)),
+		owners: make([]int, len(points)),
+	}
+	for i, p := range points {
+		ring.points[i] = p.hash
+		ring.owners[i] = p.owner
+	}
+	return &ring
+}
+
+// Get returns the database of the key. Secondary keys (the URL followed by
+// a fragment) are stored with their primary key.
+func (r *Ring) Get(key string) int {
+	return r.GetN(key, 1)[0]
+}
+
+// GetN returns the n databases of the key: the database returned by Get
+// followed by the next distinct databases on the ring.
+func (r *Ring) GetN(key string, n int) []int {
+	if len(r.points) == 0 {
+		return []int{0}
+	}
+	primary, _, _ := strings.Cut(key, "#")
+	h := hashKey(primary)
+	start := sort.Search(len(r.points), func(i int) bool {
+		return r.points[i] >= h
+	})
+	owners := make([]int, 0, n)
+	for i := range r.points {
+		owner := r.owners[(start+i)%len(r.points)]
+		if !slices.Contains(owners, owner) {
+			owners = append(owners, owner)
+			if len(owners) == n {
+				break
+			}
+		}
+	}
+	return owners
+}
+
+func hashKey(key string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	// finalizer of splitmix64, spreads the FNV hash of similar keys
+	x := h.Sum64()
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+	return x
+}
+
+// ShardedRepository looks up each key only in the databases chosen by the ring
+type ShardedRepository struct {
+	ring     *Ring
+	shards   []ResponseQuerier
+	replicas int
+}
+
+// NewShardedRepository returns a repository querying shards[i] for the keys
+// of the database i of the ring. Keys replicated to several databases are
+// looked up in the next replica when missing or when the database fails.
+func NewShardedRepository(ring *Ring, shards []ResponseQuerier, replicas int) *ShardedRepository {
+	return &ShardedRepository{
+		ring:     ring,
+		shards:   shards,
+		replicas: max(replicas, 1),
+	}
+}
+
+func (r *ShardedRepository) FindByURL(ctx context.Context, url string) (*db.Response, error) {
+	var lastErr error
+	for _, databaseID := range r.ring.GetN(url, r.replicas) {
+		resp, err := r.shards[databaseID].FindByURL(ctx, url)
+		if err != nil {
+			if !errors.Is(err, sql.ErrNoRows) {
+				lastErr = err
+			}
+			continue
+		}
+		resp.DatabaseID = databaseID
+		return resp, nil
+	}
+	return nil, notFound(lastErr)
+}
+
+// ShardedWriter writes each response into the database chosen by the ring.
+// The next writer must write into db.Response.DatabaseID.
+type ShardedWriter struct {
+	ring *Ring
+	next ResponseWriter
+}
+
+func NewShardedWriter(ring *Ring, next ResponseWriter) *ShardedWriter {
+	return &ShardedWriter{
+		ring: ring,
+		next: next,
+	}
+}
+
+func (w *ShardedWriter) Write(ctx context.Context, url string, resp *db.Response) error {
+	resp.DatabaseID = w.ring.Get(url)
+	return w.next.Write(ctx, url, resp)
+}
+
+func (w *ShardedWriter) WriteBatch(ctx context.Context, entries []Entry) (int, error) {
+	for _, entry := range entries {
+		entry.Response.DatabaseID = w.ring.Get(entry.URL)
+	}
+	return writeEntries(ctx, w.next, entries)
+}
+
+// Rebalance moves the responses stored in a database other than the ones
+// chosen by the ring (the first replicas databases of the key), after
+// databases are added. The responses are read with the shard queriers and
+// written with the writer placing them on the ring (ShardedWriter or
+// ReplicatedWriter).
+func Rebalance(ctx context.Context, ring *Ring, replicas int, dbs []*sql.DB, shards []ResponseQuerier, writer ResponseWriter) (int, error) {
+	var moved int
+	for i, sqlDB := range dbs {
+		tables, err := db.ResponseTables(sqlDB)
+		if err != nil {
+			return moved, fmt.Errorf("discovery response tables on database %d: %w", i, err)
+		}
+		for _, tableName := range tables {
+			urls, err := misplaced(ctx, ring, replicas, sqlDB, i, tableName)
+			if err != nil {
+				return moved, err
+			}
+			for _, url := range urls {
+				if err := move(ctx, sqlDB, shards[i], writer, tableName, url); err != nil {
+					slog.Error("rebalance", "error", err, "url", url, "database", i)
+					continue
+				}
+				moved++
+			}
+		}
+	}
+	return moved, nil
+}
+
+// misplaced lists the keys of the table not owned by the database
+func misplaced(ctx context.Context, ring *Ring, replicas int, sqlDB *sql.DB, databaseID int, tableName string) ([]string, error) {
+	urls, err := listKeys(ctx, sqlDB, tableName)
+	if err != nil {
+		return nil, err
+	}
+	return slices.DeleteFunc(urls, func(url string) bool {
+		return slices.Contains(ring.GetN(url, max(replicas, 1)), databaseID)
+	}), nil
+}
+
+func move(ctx context.Context, sqlDB *sql.DB, shard ResponseQuerier, writer ResponseWriter, tableName, url string) error {
+	resp, err := shard.FindByURL(ctx, url)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	resp.TableName = tableName
+	if err := writer.Write(ctx, url, resp); err != nil {
+		return err
+	}
+	_, err = sqlDB.ExecContext(ctx, "DELETE FROM "+tableName+" WHERE url = ?", url)
+	return err
+}
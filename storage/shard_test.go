@@ -0,0 +1,196 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/litesql/httpcache/db"
+)
+
+func TestRing(t *testing.T) {
+	names := []string{"a.db", "b.db", "c.db"}
+	ring := NewRing(names)
+	rebuilt := NewRing(names)
+	grown := NewRing(append(names, "d.db"))
+	counts := make([]int, 4)
+	const keys = 10000
+	for i := range keys {
+		key := fmt.Sprintf("http://example.com/item/%d?x=1", i)
+		before, after := ring.Get(key), grown.Get(key)
+		counts[after]++
+		if before != after && after != 3 {
+			t.Fatalf("%s moved from %d to %d, want only moves to the new database", key, before, after)
+		}
+		if got := grown.Get(key + "#vary:accept=json"); got != after {
+			t.Fatalf("secondary key of %s on database %d, want %d", key, got, after)
+		}
+		if got := rebuilt.Get(key); got != before {
+			t.Fatalf("%s on database %d after rebuilding the ring, want %d", key, got, before)
+		}
+	}
+	for i, n := range counts {
+		if n < keys/8 {
+			t.Errorf("database %d got %d of %d keys", i, n, keys)
+		}
+	}
+}
+
+func TestRingGetN(t *testing.T) {
+	ring := NewRing([]string{"a.db", "b.db", "c.db"})
+	for i := range 100 {
+		key := fmt.Sprintf("http://x/%d", i)
+		owners := ring.GetN(key, 2)
+		if len(owners) != 2 || owners[0] == owners[1] || owners[0] != ring.Get(key) {
+			t.Fatalf("GetN(%s, 2) = %v, want 2 distinct databases starting with %d", key, owners, ring.Get(key))
+		}
+		if owners := ring.GetN(key, 5); len(owners) != 3 {
+			t.Fatalf("GetN(%s, 5) = %v, want the 3 databases", key, owners)
+		}
+	}
+	if owners := NewRing(nil).GetN("http://x/1", 2); !slices.Equal(owners, []int{0}) {
+		t.Errorf("empty ring got %v, want [0]", owners)
+	}
+}
+
+func TestShardedRepository(t *testing.T) {
+	ctx := context.Background()
+	dbs, shards := openTestRepositories(t, 3)
+	ring := NewRing([]string{"a.db", "b.db", "c.db"})
+	tw, err := NewTableWriter(dbs, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tw.Close()
+	writer := NewShardedWriter(ring, tw)
+
+	entries := make([]Entry, 0, 50)
+	for i := range 100 {
+		url := fmt.Sprintf("http://x/%d", i)
+		if i%2 == 0 {
+			if err := writer.Write(ctx, url, newTestResponse(url, time.Now())); err != nil {
+				t.Fatal(err)
+			}
+			continue
+		}
+		entries = append(entries, Entry{URL: url, Response: newTestResponse(url, time.Now())})
+	}
+	if n, err := writer.WriteBatch(ctx, entries); err != nil || n != len(entries) {
+		t.Fatalf("got %d written, %v", n, err)
+	}
+
+	repo := NewShardedRepository(ring, shards, 1)
+	for i := range 100 {
+		url := fmt.Sprintf("http://x/%d", i)
+		if n := countRows(t, dbs[ring.Get(url)], "http_response", "url = ?", url); n != 1 {
+			t.Fatalf("%s not stored in database %d", url, ring.Get(url))
+		}
+		resp, err := repo.FindByURL(ctx, url)
+		if err != nil {
+			t.Fatal(url, err)
+		}
+		if body := readBody(t, resp); body != url || resp.DatabaseID != ring.Get(url) {
+			t.Errorf("got %q from database %d", body, resp.DatabaseID)
+		}
+	}
+	total := 0
+	for _, sqlDB := range dbs {
+		total += countRows(t, sqlDB, "http_response", "")
+	}
+	if total != 100 {
+		t.Errorf("got %d stored responses, want 100", total)
+	}
+}
+
+// failingQuerier fails every lookup
+type failingQuerier struct{}
+
+func (failingQuerier) FindByURL(ctx context.Context, url string) (*db.Response, error) {
+	return nil, errors.New("database is broken")
+}
+
+func TestShardedRepositoryReplicas(t *testing.T) {
+	ctx := context.Background()
+	dbs, shards := openTestRepositories(t, 3)
+	ring := NewRing([]string{"a.db", "b.db", "c.db"})
+	url := "http://x/1"
+	owners := ring.GetN(url, 2)
+	resp := newTestResponse("replica", time.Now())
+	resp.DatabaseID = owners[1]
+	tw, err := NewTableWriter(dbs, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tw.Close()
+	if err := tw.Write(ctx, url, resp); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := NewShardedRepository(ring, shards, 1).FindByURL(ctx, url); err == nil {
+		t.Error("found the response outside of the first database without replicas")
+	}
+	shards[owners[0]] = failingQuerier{}
+	found, err := NewShardedRepository(ring, shards, 2).FindByURL(ctx, url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if body := readBody(t, found); body != "replica" || found.DatabaseID != owners[1] {
+		t.Errorf("got %q from database %d, want the replica of database %d", body, found.DatabaseID, owners[1])
+	}
+}
+
+func TestRebalance(t *testing.T) {
+	ctx := context.Background()
+	dbs, shards := openTestRepositories(t, 4)
+	names := []string{"a.db", "b.db", "c.db"}
+	ring := NewRing(names)
+	tw, err := NewTableWriter(dbs, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tw.Close()
+	writer := NewShardedWriter(ring, tw)
+	for i := range 200 {
+		url := fmt.Sprintf("http://x/%d", i)
+		if err := writer.Write(ctx, url, newTestResponse(url, time.Now())); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	grown := NewRing(append(names, "d.db"))
+	moved, err := Rebalance(ctx, grown, 1, dbs, shards, NewShardedWriter(grown, tw))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := countRows(t, dbs[3], "http_response", ""); moved == 0 || got != moved {
+		t.Errorf("moved %d responses, the new database has %d", moved, got)
+	}
+	repo := NewShardedRepository(grown, shards, 1)
+	total := 0
+	for i, sqlDB := range dbs {
+		total += countRows(t, sqlDB, "http_response", "")
+		misplaced, err := misplaced(ctx, grown, 1, sqlDB, i, "http_response")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(misplaced) > 0 {
+			t.Errorf("database %d keeps %d misplaced responses", i, len(misplaced))
+		}
+	}
+	if total != 200 {
+		t.Errorf("got %d stored responses, want 200", total)
+	}
+	for i := range 200 {
+		url := fmt.Sprintf("http://x/%d", i)
+		resp, err := repo.FindByURL(ctx, url)
+		if err != nil {
+			t.Fatal(url, err)
+		}
+		if body := readBody(t, resp); body != url {
+			t.Errorf("%s: got body %q", url, body)
+		}
+	}
+}
@@ -0,0 +1,82 @@
+package storage
+
+import (
+	"database/sql"
+	"io"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/litesql/httpcache/db"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// openTestDB opens a temporary database with the response tables
+func openTestDB(t *testing.T, tableNames ...string) *sql.DB {
+	t.Helper()
+	if len(tableNames) == 0 {
+		tableNames = []string{"http_response"}
+	}
+	sqlDB, err := sql.Open("sqlite3", "file:"+filepath.Join(t.TempDir(), "test.db")+"?_journal=WAL&_timeout=5000&_txlock=immediate")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { sqlDB.Close() })
+	if err := db.CreateResponseTables(sqlDB, tableNames...); err != nil {
+		t.Fatal(err)
+	}
+	return sqlDB
+}
+
+// openTestRepositories opens n temporary databases and their repositories
+func openTestRepositories(t *testing.T, n int) ([]*sql.DB, []ResponseQuerier) {
+	t.Helper()
+	dbs := make([]*sql.DB, n)
+	queriers := make([]ResponseQuerier, n)
+	for i := range n {
+		dbs[i] = openTestDB(t)
+		repo, err := db.NewRepository(dbs[i], 0, 0, "http_response")
+		if err != nil {
+			t.Fatal(err)
+		}
+		queriers[i] = repo
+	}
+	return dbs, queriers
+}
+
+// newTestResponse returns a 200 response without location
+func newTestResponse(body string, responseTime time.Time) *db.Response {
+	return &db.Response{
+		Status:       200,
+		Header:       map[string][]string{"Content-Type": {"text/plain"}},
+		Body:         io.NopCloser(strings.NewReader(body)),
+		RequestTime:  responseTime,
+		ResponseTime: responseTime,
+		DatabaseID:   -1,
+	}
+}
+
+// countRows returns the number of rows of the table matching the optional condition
+func countRows(t *testing.T, sqlDB *sql.DB, tableName string, where string, args ...any) int {
+	t.Helper()
+	query := "SELECT count(*) FROM " + tableName
+	if where != "" {
+		query += " WHERE " + where
+	}
+	var n int
+	if err := sqlDB.QueryRow(query, args...).Scan(&n); err != nil {
+		t.Fatal(err)
+	}
+	return n
+}
+
+func readBody(t *testing.T, resp *db.Response) string {
+	t.Helper()
+	defer resp.Body.Close()
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b)
+}
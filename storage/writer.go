@@ -0,0 +1,270 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/litesql/httpcache/db"
+)
+
+// ResponseWriter stores responses. The writer closes the response body.
+type ResponseWriter interface {
+	Write(ctx context.Context, url string, resp *db.Response) error
+}
+
+// TableWriter writes the responses into the response table named by
+// db.Response.TableName, so responses can be routed to a given table.
+// Responses without table name are written by the next writer, or into the
+// first response table of the database when next is nil. The responses
+// written get the database and table used.
+type TableWriter struct {
+	next ResponseWriter
+	dbs  []*sql.DB
+	// response tables and their writer statements, per database
+	tables  [][]string
+	writers []map[string]*sql.Stmt
+
+	// roundRobin strategy to choose the database
+	current int
+	mu      sync.Mutex
+}
+
+// NewTableWriter prepares the writer statements for the response tables discovered on each database.
+func NewTableWriter(dbs []*sql.DB, next ResponseWriter) (*TableWriter, error) {
+	tableList := make([][]string, len(dbs))
+	writers := make([]map[string]*sql.Stmt, len(dbs))
+	for i, sqlDB := range dbs {
+		tables, err := db.ResponseTables(sqlDB)
+		if err != nil {
+			return nil, fmt.Errorf("discovery response tables on database %d: %w", i, err)
+		}
+		tableList[i] = tables
+		writers[i] = make(map[string]*sql.Stmt)
+		for _, tableName := range tables {
+			stmt, err := sqlDB.Prepare(db.WriterQuery(tableName))
+			if err != nil {
+				return nil, fmt.Errorf("prepare writer query for %q: %w", tableName, err)
+			}
+			writers[i][tableName] = stmt
+		}
+	}
+	return &TableWriter{
+		next:    next,
+		dbs:     dbs,
+		tables:  tableList,
+		writers: writers,
+	}, nil
+}
+
+// HasTable reports whether any database has the response table
+func (w *TableWriter) HasTable(tableName string) bool {
+	for _, stmts := range w.writers {
+		if _, ok := stmts[tableName]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+// Write stores the response in its table. The URL is deleted from the other
+// response tables of the database, so only one entry is found by the readers.
+func (w *TableWriter) Write(ctx context.Context, url string, resp *db.Response) error {
+	_, err := w.WriteBatch(ctx, []Entry{{URL: url, Response: resp}})
+	return err
+}
+
+// WriteBatch stores the responses with a transaction per database
+func (w *TableWriter) WriteBatch(ctx context.Context, entries []Entry) (int, error) {
+	var (
+		written int
+		errs    error
+	)
+	next := make([]Entry, 0)
+	perDatabase := make(map[int][]Entry)
+	for _, entry := range entries {
+		if entry.Response.TableName == "" && w.next != nil {
+			next = append(next, entry)
+			continue
+		}
+		databaseID, err := w.database(entry.Response)
+		if err != nil {
+			entry.Response.Body.Close()
+			errs = errors.Join(errs, err)
+			continue
+		}
+		entry.Response.DatabaseID = databaseID
+		if entry.Response.TableName == "" {
+			entry.Response.TableName = w.tables[databaseID][0]
+		}
+		perDatabase[databaseID] = append(perDatabase[databaseID], entry)
+	}
+	for databaseID, entries := range perDatabase {
+		n, err := w.writeTx(ctx, databaseID, entries)
+		written += n
+		errs = errors.Join(errs, err)
+	}
+	if len(next) > 0 {
+		n, err := writeEntries(ctx, w.next, next)
+		written += n
+		errs = errors.Join(errs, err)
+	}
+	return written, errs
+}
+
+func (w *TableWriter) writeTx(ctx context.Context, databaseID int, entries []Entry) (int, error) {
+	defer closeBodies(entries)
+	tx, err := w.dbs[databaseID].BeginTx(ctx, nil)
+	if err != nil {
+		return 0, fmt.Errorf("begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+	var (
+		written int
+		errs    error
+	)
+	for _, entry := range entries {
+		err := inSavepoint(ctx, tx, func() error {
+			return w.writeEntry(ctx, tx, databaseID, entry.Response.TableName, entry)
+		})
+		if err != nil {
+			errs = errors.Join(errs, err)
+			continue
+		}
+		written++
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, fmt.Errorf("commit: %w", err)
+	}
+	return written, errs
+}
+
+func (w *TableWriter) writeEntry(ctx context.Context, tx *sql.Tx, databaseID int, tableName string, entry Entry) error {
+	for _, other := range w.tables[databaseID] {
+		if other == tableName {
+			continue
+		}
+		if _, err := tx.ExecContext(ctx, "DELETE FROM "+other+" WHERE url = ?", entry.URL); err != nil {
+			return err
+		}
+	}
+	return execWriter(ctx, tx.StmtContext(ctx, w.writers[databaseID][tableName]), entry.URL, entry.Response)
+}
+
+// database returns the database of the response, or the next database
+// having its table when the response has no location. A response placed in
+// a database without its table is an error: writing it elsewhere would break
+// the placement and leave the old entry behind.
+func (w *TableWriter) database(resp *db.Response) (int, error) {
+	if resp.DatabaseID >= 0 && resp.DatabaseID < len(w.writers) {
+		if !w.hasTable(resp.DatabaseID, resp.TableName) {
+			return 0, fmt.Errorf("response table %q not found in database %d", resp.TableName, resp.DatabaseID)
+		}
+		return resp.DatabaseID, nil
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for range w.writers {
+		w.current = (w.current + 1) % len(w.writers)
+		if w.hasTable(w.current, resp.TableName) {
+			return w.current, nil
+		}
+	}
+	return 0, fmt.Errorf("response table %q not found", resp.TableName)
+}
+
+// hasTable reports whether the database has the table, or any table when
+// tableName is empty
+func (w *TableWriter) hasTable(databaseID int, tableName string) bool {
+	if tableName == "" {
+		return len(w.tables[databaseID]) > 0
+	}
+	_, ok := w.writers[databaseID][tableName]
+	return ok
+}
+
+func (w *TableWriter) Close() error {
+	var err error
+	for _, stmts := range w.writers {
+		for _, stmt := range stmts {
+			err = errors.Join(err, stmt.Close())
+		}
+	}
+	return err
+}
+
+// execWriter executes the statement built by db.WriterQuery
+func execWriter(ctx context.Context, stmt *sql.Stmt, url string, resp *db.Response) error {
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return fmt.Errorf("reading body: %w", err)
+	}
+	bodyStr := string(body)
+
+	var headerBuf bytes.Buffer
+	if err := json.NewEncoder(&headerBuf).Encode(resp.Header); err != nil {
+		return fmt.Errorf("encoding header: %w", err)
+	}
+	header := headerBuf.String()
+
+	requestTime := resp.RequestTime.Format(time.RFC3339Nano)
+	responseTime := resp.ResponseTime.Format(time.RFC3339Nano)
+	_, err = stmt.ExecContext(ctx,
+		url, resp.Status, bodyStr, header, requestTime, responseTime,
+		// On Conflict
+		resp.Status, bodyStr, header, requestTime, responseTime)
+	if err != nil {
+		return fmt.Errorf("store response: %w", err)
+	}
+	return nil
+}
+
+// writeEntries writes the entries with a single call when w is a BatchWriter
+func writeEntries(ctx context.Context, w ResponseWriter, entries []Entry) (int, error) {
+	if batchWriter, ok := w.(BatchWriter); ok {
+		return batchWriter.WriteBatch(ctx, entries)
+	}
+	var (
+		written int
+		errs    error
+	)
+	for _, entry := range entries {
+		err := w.Write(ctx, entry.URL, entry.Response)
+		// writers from other packages may not close the body
+		entry.Response.Body.Close()
+		if err != nil {
+			errs = errors.Join(errs, fmt.Errorf("%s: %w", entry.URL, err))
+			continue
+		}
+		written++
+	}
+	return written, errs
+}
+
+func closeBodies(entries []Entry) {
+	for _, entry := range entries {
+		entry.Response.Body.Close()
+	}
+}
+
+// inSavepoint runs fn in a savepoint, so a failed entry does not leave
+// partial changes in the batch transaction
+func inSavepoint(ctx context.Context, tx *sql.Tx, fn func() error) error {
+	if _, err := tx.ExecContext(ctx, "SAVEPOINT entry"); err != nil {
+		return err
+	}
+	if err := fn(); err != nil {
+		tx.ExecContext(ctx, "ROLLBACK TO entry")
+		tx.ExecContext(ctx, "RELEASE entry")
+		return err
+	}
+	_, err := tx.ExecContext(ctx, "RELEASE entry")
+	return err
+}